@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+type latencySummary struct {
+	messages int
+	mean float64
+	p50 int64
+	p90 int64
+	p99 int64
+	max int64
+}
+
+/* Reads a stats.json file written with GET_MESSAGE_TIMES=true and summarizes
+   the response latency of all messages in it. */
+func summarizeStats(path string) (latencySummary, error) {
+	var summary latencySummary
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return summary, err
+	}
+	var histories map[string][][2]int64
+	if err = json.Unmarshal(contents, &histories); err != nil {
+		return summary, fmt.Errorf("could not parse %v: %v", path, err)
+	}
+	var latencies []int64
+	for _, history := range histories {
+		for _, times := range history {
+			if times[0] == 0 || times[1] == 0 {
+				continue // the message was never sent or never answered
+			}
+			latencies = append(latencies, times[1] - times[0])
+		}
+	}
+	if len(latencies) == 0 {
+		return summary, fmt.Errorf("%v does not contain any completed messages", path)
+	}
+	sort.Slice(latencies, func (i int, j int) bool { return latencies[i] < latencies[j] })
+	var total float64 = 0
+	for _, latency := range latencies {
+		total += float64(latency)
+	}
+	summary.messages = len(latencies)
+	summary.mean = total / float64(len(latencies))
+	summary.p50 = latencies[len(latencies) * 50 / 100]
+	summary.p90 = latencies[len(latencies) * 90 / 100]
+	summary.p99 = latencies[len(latencies) * 99 / 100]
+	summary.max = latencies[len(latencies) - 1]
+	return summary, nil
+}
+
+func percentChange(before float64, after float64) string {
+	if before == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", 100 * (after - before) / before)
+}
+
+/* The "compare" command compares the message latencies of two runs. */
+func compareCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s compare <stats.json> <stats.json>\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Compares the message latencies recorded by two runs with GET_MESSAGE_TIMES=true.")
+		os.Exit(2)
+	}
+	a, err := summarizeStats(args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	b, err := summarizeStats(args[1])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("%-10s %16s %16s %10s\n", "", args[0], args[1], "change")
+	fmt.Printf("%-10s %16d %16d %10s\n", "messages", a.messages, b.messages, percentChange(float64(a.messages), float64(b.messages)))
+	fmt.Printf("%-10s %16.0f %16.0f %10s\n", "mean (ns)", a.mean, b.mean, percentChange(a.mean, b.mean))
+	fmt.Printf("%-10s %16d %16d %10s\n", "p50 (ns)", a.p50, b.p50, percentChange(float64(a.p50), float64(b.p50)))
+	fmt.Printf("%-10s %16d %16d %10s\n", "p90 (ns)", a.p90, b.p90, percentChange(float64(a.p90), float64(b.p90)))
+	fmt.Printf("%-10s %16d %16d %10s\n", "p99 (ns)", a.p99, b.p99, percentChange(float64(a.p99), float64(b.p99)))
+	fmt.Printf("%-10s %16d %16d %10s\n", "max (ns)", a.max, b.max, percentChange(float64(a.max), float64(b.max)))
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cparse "github.com/SoftwareDefinedBuildings/sync2_quasar/configparser"
+)
+
+const DEFAULT_CONFIG_FILE = "loadConfig.ini"
+
+/* A configuration file may set INCLUDE to a comma separated list of files
+   that it extends. Relative paths are relative to the including file. */
+const INCLUDE_KEY = "INCLUDE"
+
+/* Every key can also be set with an environment variable, e.g. QLG_TOTAL_RECORDS. */
+const ENV_PREFIX = "QLG_"
+
+/* A setting is a key that can appear in the configuration file. Every setting
+   can also be overridden on the command line with a flag named after the key
+   (TOTAL_RECORDS becomes -total-records). An empty default means that the key
+   has to be specified somewhere. */
+type setting struct {
+	key string
+	def string
+	usage string
+}
+
+var settings []setting = []setting{
+	{"TOTAL_RECORDS", "16777216", "number of points to insert or query in each stream"},
+	{"TCP_CONNECTIONS", "1", "number of TCP connections to open to each server"},
+	{"CONN_ASSIGNMENT", "roundrobin", "how workers are assigned to the connections to their server: roundrobin, perstream (a connection per stream), leastloaded, or dedicated (separate connections for inserts and queries in mixed mode)"},
+	{"SEND_MODE", "batch", "how workers write to a shared connection: batch (a writer goroutine per connection combines queued messages into large writes) or mutex (each message is written separately under a lock)"},
+	{"POINTS_PER_MESSAGE", "4096", "number of points in each insert message or query"},
+	{"NANOS_BETWEEN_POINTS", "1048576", "nanoseconds between consecutive points"},
+	{"MAX_TIME_RANDOM_OFFSET", "0", "maximum random offset added to each timestamp (must be less than NANOS_BETWEEN_POINTS)"},
+	{"FIRST_TIME", "1420582217226125312", "time of the first point, in nanoseconds"},
+	{"NUM_SERVERS", "1", "number of servers; DB_ADDR1 ... DB_ADDR<NUM_SERVERS> must be specified"},
+	{"NUM_STREAMS", "1", "number of streams"},
+	{"UUID_MODE", "list", "where the stream UUIDs come from: list (UUID1 ... UUID<NUM_STREAMS>), name (derived from UUID_PREFIX), random (generated once and kept in UUID_FILE), or file (read from UUID_FILE)"},
+	{"UUID_PREFIX", "quasarloadgenerator-", "prefix of the names that the UUIDs are derived from when UUID_MODE is name"},
+	{"UUID_FILE", "uuids.txt", "file with one UUID per line, used when UUID_MODE is random or file"},
+	{"ROUTING", "modulo", "how streams are assigned to servers: modulo (first byte of the UUID), hash (consistent hashing), roundrobin, or map (ROUTE1, ROUTE2, ...)"},
+	{"VIRTUAL_NODES", "64", "number of points of each server on the hash ring when ROUTING is hash or map"},
+	{"MAX_CONCURRENT_MESSAGES", "4", "maximum number of outstanding messages per stream"},
+	{"RAND_SEED", "15", "seed used to generate the random values and time offsets"},
+	{"PERM_SEED", "0", "seed used to shuffle the insert/query order; 0 inserts/queries in order"},
+	{"DETERMINISTIC_KV", "false", "use a sine wave at exact times instead of random values at random offsets"},
+	{"GET_MESSAGE_TIMES", "false", "write the send and response time of every message to stats.json"},
+	{"STATISTICAL_PW", "-1", "point width of statistical queries; -1 makes standard queries"},
+	{"POINTS_PER_SECOND", "0", "maximum number of points to send per second, over all streams; 0 sends as fast as possible"},
+	{"DURATION", "0", "stop sending after this long (e.g. 90s or 10m), even if not all records were sent; 0 sends all records"},
+	{"DATA_TIME_SHIFT", "false", "move the points of each DATA_FILE so that they start at FIRST_TIME"},
+	{"DATA_LOOP", "false", "repeat the points of a DATA_FILE that has fewer than TOTAL_RECORDS"},
+	{"TIME_PATTERN", "none", "irregular point times, e.g. gaps=<every>/<ns>,bursts=<every>/<points>/<ns>,jitter=<fraction>,duplicates=<chance>,reorder=<chance>/<distance>; none gives a point every NANOS_BETWEEN_POINTS"},
+	{"QUERY_ACCESS", "none", "which streams and times queries ask for, e.g. zipf=<skew>,recent=<fraction of queries>/<fraction of time>,hotspots=<count>/<fraction of time each>/<fraction of queries>,window=<min messages>/<max messages>; none queries every message once"},
+	{"QUERY_RANGES", "none", "span and point width of every query, e.g. span=1s/1y,pw=20/40 (spans are drawn log-uniformly, point widths uniformly, and a pw makes statistical queries); none covers one message at STATISTICAL_PW"},
+	{"DUPLICATES", "keep", "what the database does with points at the same time, for verifying them: keep (all of them, like BTrDB) or replace (the last one inserted wins)"},
+}
+
+/* Keys that are numbered, like UUID1, UUID2, ... These can be replaced as a
+   whole on the command line by repeating the corresponding flag. */
+var listSettings []setting = []setting{
+	{"DB_ADDR", "", "address of a server (repeat the flag for several servers)"},
+	{"UUID", "", "UUID of a stream (repeat the flag for several streams)"},
+	{"ROUTE", "", "<UUID>,<DB_ADDR> pair that sends a stream to a server when ROUTING is map (repeat the flag for several streams)"},
+	{"GROUP", "", "configuration file of a stream group, whose settings apply on top of this file for the streams of that group; all groups run at the same time (repeat the flag for several groups)"},
+	{"DATA_FILE", "", "CSV (time,value per line) or .bin file with the points to insert and query instead of generated ones (repeat the flag to give streams different files; streams take turns)"},
+}
+
+func flagName(key string) string {
+	return strings.ToLower(strings.Replace(key, "_", "-", -1))
+}
+
+/* configOverride is a flag.Value that records the value of a single key. */
+type configOverride struct {
+	key string
+	overrides map[string]string
+}
+
+func (o configOverride) String() string {
+	return ""
+}
+
+func (o configOverride) Set(value string) error {
+	o.overrides[o.key] = value
+	return nil
+}
+
+/* keyValueOverride is a flag.Value that accepts arbitrary KEY=VALUE pairs. */
+type keyValueOverride map[string]string
+
+func (o keyValueOverride) String() string {
+	return ""
+}
+
+func (o keyValueOverride) Set(value string) error {
+	var parts []string = strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	o[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+/* listOverride is a flag.Value that collects the values of a numbered key. */
+type listOverride struct {
+	key string
+	lists map[string][]string
+}
+
+func (o listOverride) String() string {
+	return ""
+}
+
+func (o listOverride) Set(value string) error {
+	o.lists[o.key] = append(o.lists[o.key], value)
+	return nil
+}
+
+type runOptions struct {
+	configPath string
+	profiles profileOptions
+	recordFile string
+	printAll bool
+	overrides map[string]string
+	lists map[string][]string
+}
+
+func newRunFlags(command string, opts *runOptions) *flag.FlagSet {
+	var fs *flag.FlagSet = flag.NewFlagSet(command, flag.ExitOnError)
+	opts.overrides = make(map[string]string)
+	opts.lists = make(map[string][]string)
+	fs.StringVar(&opts.configPath, "config", DEFAULT_CONFIG_FILE, "path to the configuration file")
+	fs.StringVar(&opts.profiles.cpu, "cpuprofile", "", "write a CPU profile to this file")
+	fs.StringVar(&opts.profiles.heap, "memprofile", "", "write a heap profile to this file when the run ends")
+	fs.StringVar(&opts.profiles.allocs, "allocsprofile", "", "write a profile of all allocations to this file when the run ends")
+	fs.StringVar(&opts.profiles.block, "blockprofile", "", "write a profile of where goroutines blocked to this file when the run ends")
+	fs.StringVar(&opts.profiles.mutex, "mutexprofile", "", "write a profile of mutex contention to this file when the run ends")
+	fs.StringVar(&opts.profiles.trace, "trace", "", "write an execution trace to this file (see go tool trace)")
+	fs.StringVar(&opts.profiles.httpAddr, "pprof", "", "serve net/http/pprof at this address (e.g. localhost:6060) during the run")
+	fs.StringVar(&opts.recordFile, "record", "", "record every request to this file, to send them again with the replay command")
+	if command == "verify" {
+		fs.BoolVar(&opts.printAll, "print-all", false, "print every point that is verified")
+	}
+	fs.Var(keyValueOverride(opts.overrides), "set", "override an arbitrary configuration key (KEY=VALUE, may be repeated)")
+	for _, s := range settings {
+		fs.Var(configOverride{s.key, opts.overrides}, flagName(s.key), s.usage)
+	}
+	for _, s := range listSettings {
+		fs.Var(listOverride{s.key, opts.lists}, flagName(s.key), s.usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags]\n\nFlags:\n", os.Args[0], command)
+		fs.PrintDefaults()
+		fmt.Fprintln(os.Stderr)
+		printSettings()
+	}
+	return fs
+}
+
+func printSettings() {
+	fmt.Fprintln(os.Stderr, "Settings are taken from the defaults, then the configuration file (and the files")
+	fmt.Fprintf(os.Stderr, "it INCLUDEs), then environment variables named %v<KEY>, then the command line.\n\n", ENV_PREFIX)
+	fmt.Fprintln(os.Stderr, "Settings (configuration file key, command line flag, default):")
+	for _, s := range settings {
+		fmt.Fprintf(os.Stderr, "  %-24s -%-24s %s\n", s.key, flagName(s.key), s.def)
+		fmt.Fprintf(os.Stderr, "      %s\n", s.usage)
+	}
+	for _, s := range listSettings {
+		fmt.Fprintf(os.Stderr, "  %-24s -%-24s %s\n", s.key + "<n>", flagName(s.key), "(none)")
+		fmt.Fprintf(os.Stderr, "      %s\n", s.usage)
+	}
+}
+
+/* Removes KEY1, KEY2, ... from the configuration. */
+func deleteList(config map[string]interface{}, key string) {
+	for i := 1; ; i++ {
+		if _, ok := config[fmt.Sprintf("%v%v", key, i)]; !ok {
+			return
+		}
+		delete(config, fmt.Sprintf("%v%v", key, i))
+	}
+}
+
+/* Applies the keys in over on top of base. Numbered keys are replaced as a
+   whole, so a file that lists its own UUIDs does not inherit extra ones. */
+func mergeConfig(base map[string]interface{}, over map[string]interface{}) {
+	for _, s := range listSettings {
+		if _, ok := over[s.key + "1"]; ok {
+			deleteList(base, s.key)
+		}
+	}
+	for key, value := range over {
+		base[key] = value
+	}
+}
+
+/* Reads a configuration file and everything that it includes. */
+func readConfigFile(path string, including []string) (map[string]interface{}, bool) {
+	for _, other := range including {
+		if other == path {
+			fmt.Printf("%v includes itself\n", path)
+			return nil, true
+		}
+	}
+	
+	configfile, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Could not read %v: %v\n", path, err)
+		return nil, true
+	}
+
+	config, isErr := cparse.ParseConfig(string(configfile))
+	if isErr {
+		fmt.Printf("There were errors while parsing %v. See above.\n", path)
+		return nil, true
+	}
+	
+	/* Groups are relative to the file that lists them, which may be one
+	   that another includes from somewhere else. */
+	for i := 1; i <= countList(config, "GROUP"); i++ {
+		var key string = fmt.Sprintf("GROUP%v", i)
+		if name, _ := config[key].(string); name != "" && !filepath.IsAbs(name) {
+			if abs, err := filepath.Abs(filepath.Join(filepath.Dir(path), name)); err == nil {
+				config[key] = abs
+			}
+		}
+	}
+
+	include, ok := config[INCLUDE_KEY]
+	if !ok {
+		return config, false
+	}
+	delete(config, INCLUDE_KEY)
+	
+	var merged map[string]interface{} = make(map[string]interface{})
+	for _, name := range strings.Split(include.(string), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(path), name)
+		}
+		base, isErr := readConfigFile(name, append(including, path))
+		if isErr {
+			return nil, true
+		}
+		mergeConfig(merged, base)
+	}
+	mergeConfig(merged, config)
+	return merged, false
+}
+
+/* Reads the configuration file, fills in the defaults of any settings that
+   it does not mention, and applies the environment and the command line
+   overrides on top. */
+func loadConfig(opts *runOptions) (map[string]interface{}, bool) {
+	config, isErr := readConfigFile(opts.configPath, nil)
+	if isErr {
+		return nil, true
+	}
+
+	for _, s := range settings {
+		if _, ok := config[s.key]; !ok && s.def != "" {
+			config[s.key] = s.def
+		}
+	}
+	applyOverrides(config, opts)
+	return config, false
+}
+
+/* Applies the environment and the command line overrides to config. */
+func applyOverrides(config map[string]interface{}, opts *runOptions) {
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, ENV_PREFIX) {
+			continue
+		}
+		var parts []string = strings.SplitN(env[len(ENV_PREFIX):], "=", 2)
+		if len(parts) == 2 && parts[0] != "" {
+			config[parts[0]] = parts[1]
+		}
+	}
+	for key, values := range opts.lists {
+		deleteList(config, key)
+		for i, value := range values {
+			config[fmt.Sprintf("%v%v", key, i + 1)] = value
+		}
+	}
+	for key, value := range opts.overrides {
+		config[key] = value
+	}
+}
+
+/* Prints the configuration in the format of the configuration file: the
+   settings first, then the numbered keys, then anything else. */
+func dumpConfig(config map[string]interface{}) {
+	var printed map[string]bool = make(map[string]bool)
+	var printKey = func (key string) {
+		fmt.Printf("%v=%v\n", key, config[key])
+		printed[key] = true
+	}
+	for _, s := range settings {
+		if _, ok := config[s.key]; ok {
+			printKey(s.key)
+		}
+	}
+	for _, s := range listSettings {
+		for i := 1; ; i++ {
+			var key string = fmt.Sprintf("%v%v", s.key, i)
+			if _, ok := config[key]; !ok {
+				break
+			}
+			printKey(key)
+		}
+	}
+	var rest []string
+	for key := range config {
+		if !printed[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		printKey(key)
+	}
+}
+
+/* The "config" command works with the configuration without running anything. */
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config dump [flags]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Prints the effective configuration after applying includes, the environment and the flags.")
+		os.Exit(2)
+	}
+	var opts runOptions
+	newRunFlags("config dump", &opts).Parse(args[1:])
+	config, isErr := loadConfig(&opts)
+	if isErr {
+		os.Exit(1)
+	}
+	dumpConfig(config)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+/* The defaults with one server and one stream, which is valid for every command. */
+func defaultConfig() map[string]interface{} {
+	var config map[string]interface{} = make(map[string]interface{})
+	for _, s := range settings {
+		config[s.key] = s.def
+	}
+	config["DB_ADDR1"] = "localhost:4410"
+	config["UUID1"] = "9f67541c-95ee-11e4-a7ac-0026b6df9cf2"
+	return config
+}
+
+func writeFile(t *testing.T, dir string, name string, contents string) string {
+	var path string = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/* Returns what f prints. */
+func captureStdout(t *testing.T, f func ()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout *os.File = os.Stdout
+	os.Stdout = writer
+	var done chan []byte = make(chan []byte)
+	go func () {
+		out, _ := ioutil.ReadAll(reader)
+		done <- out
+	}()
+	f()
+	os.Stdout = stdout
+	writer.Close()
+	return string(<-done)
+}
+
+/* validateConfig has to report everything that is wrong at once, but a
+   setting that cannot be parsed only once, and not again in the checks that
+   depend on it. */
+func TestValidateConfig(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		command string
+		change map[string]interface{}
+		keys []string
+	}{
+		{"default", "insert", nil, nil},
+		{"default verify", "verify", nil, nil},
+		{"unparsable", "insert", map[string]interface{}{
+			"TOTAL_RECORDS": "lots",
+			"SEND_MODE": "fast",
+			"DETERMINISTIC_KV": "yes",
+			"DURATION": "-1s",
+		}, []string{"DETERMINISTIC_KV", "DURATION", "SEND_MODE", "TOTAL_RECORDS"}},
+		{"out of range", "insert", map[string]interface{}{
+			"POINTS_PER_MESSAGE": "0",
+			"TOTAL_RECORDS": "1000",
+			"STATISTICAL_PW": "64",
+			"POINTS_PER_SECOND": "-1",
+		}, []string{"POINTS_PER_MESSAGE", "POINTS_PER_SECOND", "STATISTICAL_PW"}},
+		{"lists", "insert", map[string]interface{}{
+			"NUM_SERVERS": "2",
+			"NUM_STREAMS": "2",
+			"UUID1": "not-a-uuid",
+			"ROUTE1": "9f67541c-95ee-11e4-a7ac-0026b6df9cf2,localhost:4410",
+		}, []string{"DB_ADDR", "ROUTING", "UUID", "UUID1"}},
+		{"unknown choices", "query", map[string]interface{}{
+			"TOTAL_RECORDS": "1000",
+			"UUID_MODE": "guess",
+			"ROUTING": "nearest",
+			"TIME_PATTERN": "gaps=often",
+		}, []string{"ROUTING", "TIME_PATTERN", "TOTAL_RECORDS", "UUID_MODE"}},
+		{"verify", "verify", map[string]interface{}{
+			"QUERY_RANGES": "span=1s/1y",
+			"DATA_FILE1": "does-not-exist.csv",
+			"STATISTICAL_PW": "30",
+		}, []string{"DATA_FILE1", "QUERY_RANGES", "STATISTICAL_PW"}},
+		{"lists and runner", "insert", map[string]interface{}{
+			"NUM_SERVERS": "2",
+			"TCP_CONNECTIONS": "0",
+			"SEND_MODE": "fast",
+			"DURATION": "-1s",
+		}, []string{"DB_ADDR", "DURATION", "SEND_MODE", "TCP_CONNECTIONS"}},
+		{"runner", "verify", map[string]interface{}{
+			"MAX_TIME_RANDOM_OFFSET": "1048576",
+			"PERM_SEED": "3",
+		}, []string{"MAX_TIME_RANDOM_OFFSET", "PERM_SEED"}},
+	} {
+		var config map[string]interface{} = defaultConfig()
+		for key, value := range test.change {
+			config[key] = value
+		}
+		var keys []string
+		for _, p := range validateConfig(config, test.command) {
+			keys = append(keys, p.key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%v: problems with %v, want %v", test.name, keys, test.keys)
+		}
+	}
+}
+
+/* Settings come from the defaults, then the included files, then the file,
+   then the environment, then the command line, each replacing the one before;
+   numbered keys are replaced as a whole. */
+func TestLoadConfig(t *testing.T) {
+	var dir string = t.TempDir()
+	writeFile(t, dir, "base.ini", strings.Join([]string{
+		"TOTAL_RECORDS=1024",
+		"POINTS_PER_MESSAGE=64",
+		"NANOS_BETWEEN_POINTS=1000",
+		"DB_ADDR1=base:4410",
+		"UUID1=9f67541c-95ee-11e4-a7ac-0026b6df9cf2",
+		"UUID2=221b154e-95de-11e4-bf98-0026b6df9cf2",
+	}, "\n"))
+	writeFile(t, dir, "servers.ini", "DB_ADDR1=other:4410\nDB_ADDR2=other:4411\nNUM_SERVERS=2\n")
+	var path string = writeFile(t, dir, "main.ini", strings.Join([]string{
+		"INCLUDE=base.ini, servers.ini",
+		"TOTAL_RECORDS=2048",
+		"NUM_STREAMS=1",
+		"UUID1=9f67541c-95ee-11e4-a7ac-0026b6df9cf3",
+	}, "\n"))
+	writeFile(t, dir, "loop.ini", "INCLUDE=loop.ini\n")
+	t.Setenv(ENV_PREFIX + "TOTAL_RECORDS", "4096")
+	t.Setenv(ENV_PREFIX + "POINTS_PER_MESSAGE", "128")
+	t.Setenv(ENV_PREFIX + "NUM_STREAMS", "2")
+
+	for _, test := range []struct {
+		name string
+		args []string
+		want map[string]string // "" for keys that must not be set
+	}{
+		{"file and environment", nil, map[string]string{
+			"INCLUDE": "",
+			"TOTAL_RECORDS": "4096",
+			"POINTS_PER_MESSAGE": "128",
+			"NANOS_BETWEEN_POINTS": "1000",
+			"NUM_STREAMS": "2",
+			"SEND_MODE": "batch",
+			"NUM_SERVERS": "2",
+			"DB_ADDR1": "other:4410",
+			"DB_ADDR2": "other:4411",
+			"UUID1": "9f67541c-95ee-11e4-a7ac-0026b6df9cf3",
+			"UUID2": "",
+		}},
+		{"flags", []string{"-total-records", "8192", "-set", "SEND_MODE=mutex", "-db-addr", "flag:4410", "-set", "EXTRA=1"}, map[string]string{
+			"TOTAL_RECORDS": "8192",
+			"POINTS_PER_MESSAGE": "128",
+			"SEND_MODE": "mutex",
+			"DB_ADDR1": "flag:4410",
+			"DB_ADDR2": "",
+			"EXTRA": "1",
+		}},
+	} {
+		var opts runOptions
+		newRunFlags("insert", &opts).Parse(append([]string{"-config", path}, test.args...))
+		config, isErr := loadConfig(&opts)
+		if isErr {
+			t.Fatalf("%v: could not load %v", test.name, path)
+		}
+		for key, want := range test.want {
+			value, ok := config[key]
+			if want == "" && ok || want != "" && value != want {
+				t.Errorf("%v: %v=%v, want %q", test.name, key, value, want)
+			}
+		}
+
+		/* What config dump prints reads back as the same configuration. */
+		var dumped string = captureStdout(t, func () { dumpConfig(config) })
+		if !strings.HasPrefix(dumped, "TOTAL_RECORDS=") {
+			t.Errorf("%v: dump does not start with the settings:\n%v", test.name, dumped)
+		}
+		reread, isErr := readConfigFile(writeFile(t, dir, "dump.ini", dumped), nil)
+		if isErr || !reflect.DeepEqual(reread, config) {
+			t.Errorf("%v: dump reads back as %v, want %v", test.name, reread, config)
+		}
+	}
+
+	var opts runOptions
+	newRunFlags("insert", &opts).Parse([]string{"-config", filepath.Join(dir, "loop.ini")})
+	if _, isErr := loadConfig(&opts); !isErr {
+		t.Errorf("loaded a file that includes itself")
+	}
+}
+
+func TestStreamUUIDs(t *testing.T) {
+	var dir string = t.TempDir()
+	var listed []string = []string{"9f67541c-95ee-11e4-a7ac-0026b6df9cf2", "221b154e-95de-11e4-bf98-0026b6df9cf2"}
+	var file string = writeFile(t, dir, "uuids.txt", "# streams\n" + listed[0] + "\n\n  " + strings.ToUpper(listed[1]) + "\n")
+	var bad string = writeFile(t, dir, "bad.txt", listed[0] + "\nnot-a-uuid\n")
+	for _, test := range []struct {
+		name string
+		mode string
+		file string
+		numStreams int
+		want []string // nil for modes whose UUIDs are not known in advance
+		err string
+	}{
+		{"list", "list", "", 2, listed, ""},
+		{"name", "name", "", 3, nil, ""},
+		{"file", "file", file, 2, listed, ""},
+		{"fewer in file", "file", file, 1, listed[:1], ""},
+		{"more than in file", "file", file, 3, nil, "contains 2 UUIDs"},
+		{"invalid line", "file", bad, 1, nil, "bad.txt:2"},
+		{"missing file", "file", filepath.Join(dir, "missing.txt"), 1, nil, "missing.txt"},
+		{"existing random", "random", file, 2, listed, ""},
+	} {
+		var config map[string]interface{} = defaultConfig()
+		config["UUID_MODE"] = test.mode
+		config["UUID_FILE"] = test.file
+		config["UUID2"] = listed[1]
+		uuids, err := getStreamUUIDs(config, test.numStreams, false)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: %v, want an error with %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || len(uuids) != test.numStreams {
+			t.Errorf("%v: %v UUIDs, %v", test.name, len(uuids), err)
+			continue
+		}
+		for j, u := range uuids {
+			if test.want != nil && uuid.UUID(u).String() != test.want[j] {
+				t.Errorf("%v: stream %v has %v, want %v", test.name, j, uuid.UUID(u), test.want[j])
+			}
+		}
+	}
+
+	/* Names give the same UUIDs every time, and other ones for another prefix. */
+	var config map[string]interface{} = defaultConfig()
+	config["UUID_MODE"] = "name"
+	first, _ := getStreamUUIDs(config, 3, true)
+	again, _ := getStreamUUIDs(config, 3, true)
+	config["UUID_PREFIX"] = "other-"
+	other, _ := getStreamUUIDs(config, 3, true)
+	if !reflect.DeepEqual(first, again) || reflect.DeepEqual(first, other) || string(first[0]) == string(first[1]) {
+		t.Errorf("names gave %v, then %v, and %v for another prefix", first, again, other)
+	}
+	if version, _ := uuid.UUID(first[0]).Version(); version != 5 {
+		t.Errorf("name based UUID %v is of version %v", uuid.UUID(first[0]), version)
+	}
+
+	/* Random UUIDs are only written when the run needs them, and then kept. */
+	config["UUID_MODE"] = "random"
+	config["UUID_FILE"] = filepath.Join(dir, "random.txt")
+	if uuids, err := getStreamUUIDs(config, 4, false); uuids != nil || err != nil {
+		t.Errorf("checking for random UUIDs returned %v, %v", uuids, err)
+	}
+	if _, err := os.Stat(config["UUID_FILE"].(string)); !os.IsNotExist(err) {
+		t.Errorf("checking for random UUIDs wrote the file")
+	}
+	created, err := getStreamUUIDs(config, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reread, err := getStreamUUIDs(config, 4, true)
+	if err != nil || !reflect.DeepEqual(created, reread) {
+		t.Errorf("random UUIDs %v read back as %v, %v", created, reread, err)
+	}
+}
+
+/* buildRunConfig returns the first problem instead of exiting, whatever it gets. */
+func TestBuildRunConfig(t *testing.T) {
+	if _, err := buildRunConfig("", "insert", defaultConfig(), false, CHECK_UUID_FILE); err != nil {
+		t.Errorf("default: %v", err)
+	}
+	for key, value := range map[string]interface{}{
+		"TOTAL_RECORDS": "lots",
+		"SEND_MODE": []string{"batch", "mutex"},
+		"DURATION": "soon",
+		"TIME_PATTERN": "gaps=often",
+		"QUERY_ACCESS": "zipf=x",
+		"QUERY_RANGES": "span=often",
+		"DETERMINISTIC_KV": "yes",
+		"NUM_STREAMS": "-1",
+	} {
+		var config map[string]interface{} = defaultConfig()
+		config[key] = value
+		if _, err := buildRunConfig("", "insert", config, false, CHECK_UUID_FILE); err == nil || !strings.HasPrefix(err.Error(), key) {
+			t.Errorf("%v=%v: %v", key, value, err)
+		}
+	}
+}
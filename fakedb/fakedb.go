@@ -0,0 +1,449 @@
+/* Package fakedb is a BTrDB (Quasar) server that keeps its streams in memory.
+   It speaks the same capnp protocol as the real database, so the load
+   generator and its verification can be tested without one:
+
+	srv, err := fakedb.Listen("localhost:0")
+	...
+	cfg.DB_ADDRS = []string{srv.Addr()}
+	...
+	srv.Close()
+
+   It answers insert, standard, statistical and window queries, delete, flush
+   and version requests. It is meant for tests, not for measuring anything:
+   every request on a connection is answered before the next one is read,
+   unless SetFaults makes it misbehave. */
+package fakedb
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"sort"
+	"sync"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* The points of a stream, by time; there is more than one at a time unless
+   the server replaces duplicates. times holds the keys of points, and is only kept
+   sorted when a query needs it, since inserts usually come in order anyway. */
+type stream struct {
+	points map[int64][]float64
+	count int
+	times []int64
+	sorted bool
+	version uint64
+}
+
+type Server struct {
+	/* The most records that go into one response; longer results are split
+	   over several responses, all but the last with Final=false. 0 means no
+	   limit. Set it before the first request arrives, or later with
+	   SetChunkSize. */
+	ChunkSize int
+
+	/* Replace a point with one that is inserted at the same time, rather
+	   than keep both like BTrDB does. Set it before the first request arrives. */
+	ReplaceDuplicates bool
+
+	lock sync.Mutex
+	faults Faults
+	streams map[string]*stream
+	listener net.Listener
+	conns map[net.Conn]bool
+	closed bool
+	wg sync.WaitGroup
+}
+
+func NewServer() *Server {
+	return &Server{streams: make(map[string]*stream), conns: make(map[net.Conn]bool)}
+}
+
+/* Starts a server on addr (e.g. "localhost:0" for any free port) that serves
+   in the background until it is closed. */
+func Listen(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var srv *Server = NewServer()
+	srv.listener = listener // so that Addr works right away
+	srv.wg.Add(1)
+	go func () {
+		srv.Serve(listener)
+		srv.wg.Done()
+	}()
+	return srv, nil
+}
+
+/* Accepts connections on listener and answers their requests. Returns when
+   the listener fails, e.g. because the server is closed. */
+func (srv *Server) Serve(listener net.Listener) error {
+	srv.lock.Lock()
+	srv.listener = listener
+	srv.lock.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		srv.lock.Lock()
+		if srv.closed {
+			srv.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		srv.conns[conn] = true
+		srv.wg.Add(1)
+		var faults Faults = srv.faults
+		srv.lock.Unlock()
+		go func () {
+			if faults == (Faults{}) {
+				srv.serveConn(conn)
+			} else {
+				srv.serveFaultyConn(conn, faults)
+			}
+			srv.lock.Lock()
+			delete(srv.conns, conn)
+			srv.lock.Unlock()
+			conn.Close()
+			srv.wg.Done()
+		}()
+	}
+}
+
+/* The address the server listens on. */
+func (srv *Server) Addr() string {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.listener == nil {
+		return ""
+	}
+	return srv.listener.Addr().String()
+}
+
+/* Stops listening, closes every connection and waits until they are done. */
+func (srv *Server) Close() error {
+	srv.lock.Lock()
+	srv.closed = true
+	var err error
+	if srv.listener != nil {
+		err = srv.listener.Close()
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.lock.Unlock()
+	srv.wg.Wait()
+	return err
+}
+
+/* Returns the number of points in a stream. */
+func (srv *Server) NumPoints(uuid []byte) int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if s, ok := srv.streams[string(uuid)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+/* Returns the number of streams and of points that the server holds. */
+func (srv *Server) Size() (int, int) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	var points int = 0
+	for _, s := range srv.streams {
+		points += s.count
+	}
+	return len(srv.streams), points
+}
+
+func (srv *Server) serveConn(conn net.Conn) {
+	var buf bytes.Buffer
+	for {
+		seg, err := capnp.ReadFromStream(conn, &buf)
+		if err != nil {
+			return
+		}
+		for _, out := range srv.Handle(cpint.ReadRootRequest(seg)) {
+			if _, err = out.WriteTo(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/* Returns the responses to a request, in the order in which they are sent. */
+func (srv *Server) Handle(req cpint.Request) []*capnp.Segment {
+	switch req.Which() {
+	case cpint.REQUEST_INSERTVALUES:
+		var insert cpint.CmdInsertValues = req.InsertValues()
+		srv.insert(insert.Uuid(), insert.Values().ToArray())
+		return []*capnp.Segment{newResponse(req, cpint.STATUSCODE_OK, true)}
+	case cpint.REQUEST_DELETEVALUES:
+		var del cpint.CmdDeleteValues = req.DeleteValues()
+		srv.delete(del.Uuid(), del.StartTime(), del.EndTime())
+		return []*capnp.Segment{newResponse(req, cpint.STATUSCODE_OK, true)}
+	case cpint.REQUEST_FLUSH:
+		return []*capnp.Segment{newResponse(req, cpint.STATUSCODE_OK, true)}
+	case cpint.REQUEST_QUERYSTANDARDVALUES:
+		var query cpint.CmdQueryStandardValues = req.QueryStandardValues()
+		times, values, version := srv.standard(query.Uuid(), query.StartTime(), query.EndTime())
+		return srv.recordResponses(req, times, values, version)
+	case cpint.REQUEST_QUERYSTATISTICALVALUES:
+		var query cpint.CmdQueryStatisticalValues = req.QueryStatisticalValues()
+		if query.PointWidth() > 62 {
+			return []*capnp.Segment{newResponse(req, cpint.STATUSCODE_INTERNALERROR, true)}
+		}
+		/* Like the real database, we round both ends of the query down to
+		   multiples of 2^pw, so the windows are aligned to them. */
+		var width int64 = int64(1) << query.PointWidth()
+		stats, version := srv.windows(query.Uuid(), query.StartTime() &^ (width - 1), query.EndTime() &^ (width - 1), width)
+		return srv.statisticalResponses(req, stats, version)
+	case cpint.REQUEST_QUERYWINDOWVALUES:
+		var query cpint.CmdQueryWindowValues = req.QueryWindowValues()
+		if query.Width() == 0 || query.Width() > math.MaxInt64 {
+			return []*capnp.Segment{newResponse(req, cpint.STATUSCODE_INTERNALERROR, true)}
+		}
+		/* Windows start at the start of the query. */
+		stats, version := srv.windows(query.Uuid(), query.StartTime(), query.EndTime(), int64(query.Width()))
+		return srv.statisticalResponses(req, stats, version)
+	case cpint.REQUEST_QUERYVERSION:
+		return []*capnp.Segment{srv.versionResponse(req, req.QueryVersion().Uuids().ToArray())}
+	}
+	return []*capnp.Segment{newResponse(req, cpint.STATUSCODE_INTERNALERROR, true)}
+}
+
+/* Returns a segment with a void response to req. */
+func newResponse(req cpint.Request, status cpint.StatusCode, final bool) *capnp.Segment {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var resp cpint.Response = cpint.NewRootResponse(seg)
+	resp.SetEchoTag(req.EchoTag())
+	resp.SetStatusCode(status)
+	resp.SetFinal(final)
+	resp.SetVoid()
+	return seg
+}
+
+func (srv *Server) insert(uuid []byte, records []cpint.Record) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	var s *stream = srv.streams[string(uuid)]
+	if s == nil {
+		s = &stream{points: make(map[int64][]float64), sorted: true}
+		srv.streams[string(uuid)] = s
+	}
+	for _, record := range records {
+		var t int64 = record.Time()
+		if _, ok := s.points[t]; !ok {
+			if len(s.times) != 0 && t < s.times[len(s.times) - 1] {
+				s.sorted = false
+			}
+			s.times = append(s.times, t)
+		}
+		if srv.ReplaceDuplicates {
+			s.count += 1 - len(s.points[t])
+			s.points[t] = []float64{record.Value()} // a point at the same time replaces the old one
+		} else {
+			s.points[t] = append(s.points[t], record.Value())
+			s.count++
+		}
+	}
+	s.version++
+}
+
+func (srv *Server) delete(uuid []byte, start int64, end int64) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	var s *stream = srv.streams[string(uuid)]
+	if s == nil {
+		return
+	}
+	var kept []int64 = s.times[:0]
+	for _, t := range s.times {
+		if t >= start && t < end {
+			s.count -= len(s.points[t])
+			delete(s.points, t)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	s.times = kept
+	s.version++
+}
+
+/* Returns the index range of the times in [start, end) of a stream. Must be
+   called with the lock held. */
+func (s *stream) span(start int64, end int64) (int, int) {
+	if !s.sorted {
+		sort.Slice(s.times, func (i int, j int) bool {
+			return s.times[i] < s.times[j]
+		})
+		s.sorted = true
+	}
+	var first int = sort.Search(len(s.times), func (i int) bool {
+		return s.times[i] >= start
+	})
+	var last int = sort.Search(len(s.times), func (i int) bool {
+		return s.times[i] >= end
+	})
+	return first, last
+}
+
+func (srv *Server) standard(uuid []byte, start int64, end int64) ([]int64, []float64, uint64) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	var s *stream = srv.streams[string(uuid)]
+	if s == nil {
+		return nil, nil, 0
+	}
+	first, last := s.span(start, end)
+	var times []int64
+	var values []float64
+	for _, t := range s.times[first:last] {
+		for _, value := range s.points[t] {
+			times = append(times, t)
+			values = append(values, value)
+		}
+	}
+	return times, values, s.version
+}
+
+type window struct {
+	time int64
+	min float64
+	mean float64
+	max float64
+	count uint64
+}
+
+/* Returns the non-empty windows of the given width from start, up to end.
+   A window that does not end by end is left out. */
+func (srv *Server) windows(uuid []byte, start int64, end int64, width int64) ([]window, uint64) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	var s *stream = srv.streams[string(uuid)]
+	if s == nil || end <= start {
+		return nil, 0
+	}
+	first, last := s.span(start, start + (end - start) / width * width)
+	var windows []window
+	for i := first; i < last; i++ {
+		var t int64 = s.times[i]
+		var wstart int64 = start + (t - start) / width * width
+		if len(windows) == 0 || windows[len(windows) - 1].time != wstart {
+			windows = append(windows, window{time: wstart, min: math.Inf(1), max: math.Inf(-1)})
+		}
+		var w *window = &windows[len(windows) - 1]
+		for _, value := range s.points[t] {
+			w.min = math.Min(w.min, value)
+			w.max = math.Max(w.max, value)
+			w.mean += value
+			w.count++
+		}
+	}
+	for i := range windows {
+		windows[i].mean /= float64(windows[i].count)
+	}
+	return windows, s.version
+}
+
+/* Splits n records into the chunks that go into one response each. */
+func (srv *Server) chunks(n int) [][2]int {
+	if n == 0 {
+		return [][2]int{{0, 0}} // an empty result still gets a response
+	}
+	srv.lock.Lock()
+	var size int = srv.ChunkSize
+	srv.lock.Unlock()
+	if size <= 0 || size > n {
+		size = n
+	}
+	var result [][2]int
+	for i := 0; i < n; i += size {
+		var end int = i + size
+		if end > n {
+			end = n
+		}
+		result = append(result, [2]int{i, end})
+	}
+	return result
+}
+
+func (srv *Server) recordResponses(req cpint.Request, times []int64, values []float64, version uint64) []*capnp.Segment {
+	var chunks [][2]int = srv.chunks(len(times))
+	var segs []*capnp.Segment = make([]*capnp.Segment, len(chunks))
+	for c, chunk := range chunks {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var resp cpint.Response = cpint.NewRootResponse(seg)
+		resp.SetEchoTag(req.EchoTag())
+		resp.SetStatusCode(cpint.STATUSCODE_OK)
+		resp.SetFinal(c == len(chunks) - 1)
+		var records cpint.Records = cpint.NewRecords(seg)
+		var list cpint.Record_List = cpint.NewRecordList(seg, chunk[1] - chunk[0])
+		for i := chunk[0]; i < chunk[1]; i++ {
+			var record cpint.Record = cpint.NewRecord(seg)
+			record.SetTime(times[i])
+			record.SetValue(values[i])
+			list.Set(i - chunk[0], record)
+		}
+		records.SetVersion(version)
+		records.SetValues(list)
+		resp.SetRecords(records)
+		segs[c] = seg
+	}
+	return segs
+}
+
+func (srv *Server) statisticalResponses(req cpint.Request, windows []window, version uint64) []*capnp.Segment {
+	var chunks [][2]int = srv.chunks(len(windows))
+	var segs []*capnp.Segment = make([]*capnp.Segment, len(chunks))
+	for c, chunk := range chunks {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var resp cpint.Response = cpint.NewRootResponse(seg)
+		resp.SetEchoTag(req.EchoTag())
+		resp.SetStatusCode(cpint.STATUSCODE_OK)
+		resp.SetFinal(c == len(chunks) - 1)
+		var records cpint.StatisticalRecords = cpint.NewStatisticalRecords(seg)
+		var list cpint.StatisticalRecord_List = cpint.NewStatisticalRecordList(seg, chunk[1] - chunk[0])
+		for i := chunk[0]; i < chunk[1]; i++ {
+			var record cpint.StatisticalRecord = cpint.NewStatisticalRecord(seg)
+			record.SetTime(windows[i].time)
+			record.SetMin(windows[i].min)
+			record.SetMean(windows[i].mean)
+			record.SetMax(windows[i].max)
+			record.SetCount(windows[i].count)
+			list.Set(i - chunk[0], record)
+		}
+		records.SetVersion(version)
+		records.SetValues(list)
+		resp.SetStatisticalRecords(records)
+		segs[c] = seg
+	}
+	return segs
+}
+
+func (srv *Server) versionResponse(req cpint.Request, uuids [][]byte) *capnp.Segment {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var resp cpint.Response = cpint.NewRootResponse(seg)
+	resp.SetEchoTag(req.EchoTag())
+	resp.SetStatusCode(cpint.STATUSCODE_OK)
+	resp.SetFinal(true)
+	var versions cpint.Versions = cpint.NewVersions(seg)
+	var ids capnp.DataList = seg.NewDataList(len(uuids))
+	var numbers capnp.UInt64List = seg.NewUInt64List(len(uuids))
+	srv.lock.Lock()
+	for i, uuid := range uuids {
+		ids.Set(i, uuid)
+		if s, ok := srv.streams[string(uuid)]; ok {
+			numbers.Set(i, s.version)
+		}
+	}
+	srv.lock.Unlock()
+	versions.SetUuids(ids)
+	versions.SetVersions(numbers)
+	resp.SetVersionList(versions)
+	return seg
+}
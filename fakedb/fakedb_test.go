@@ -0,0 +1,222 @@
+package fakedb
+
+import (
+	"testing"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+var testUUID []byte = []byte("0123456789abcdef")
+
+func newRequest() (*capnp.Segment, cpint.Request) {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var req cpint.Request = cpint.NewRootRequest(seg)
+	req.SetEchoTag(7)
+	return seg, req
+}
+
+/* Inserts the points (t, t) for t in times. */
+func insert(srv *Server, times ...int64) {
+	seg, req := newRequest()
+	var cmd cpint.CmdInsertValues = cpint.NewCmdInsertValues(seg)
+	var list cpint.Record_List = cpint.NewRecordList(seg, len(times))
+	for i, t := range times {
+		var record cpint.Record = cpint.NewRecord(seg)
+		record.SetTime(t)
+		record.SetValue(float64(t))
+		list.Set(i, record)
+	}
+	cmd.SetUuid(testUUID)
+	cmd.SetValues(list)
+	req.SetInsertValues(cmd)
+	srv.Handle(req)
+}
+
+func responses(segs []*capnp.Segment) []cpint.Response {
+	var resps []cpint.Response
+	for _, seg := range segs {
+		resps = append(resps, cpint.ReadRootResponse(seg))
+	}
+	return resps
+}
+
+func TestStandard(t *testing.T) {
+	var srv *Server = NewServer()
+	srv.ReplaceDuplicates = true
+	insert(srv, 5, 1, 3, 2, 4, 9) // out of order on purpose
+	insert(srv, 3) // replaces the first 3
+
+	for _, test := range []struct {
+		start, end int64
+		chunkSize int
+		want []int
+	}{
+		{0, 100, 0, []int{6}},
+		{2, 5, 0, []int{3}},
+		{6, 9, 0, []int{0}},
+		{0, 100, 4, []int{4, 2}},
+		{0, 100, 3, []int{3, 3}},
+	} {
+		srv.ChunkSize = test.chunkSize
+		seg, req := newRequest()
+		var cmd cpint.CmdQueryStandardValues = cpint.NewCmdQueryStandardValues(seg)
+		cmd.SetUuid(testUUID)
+		cmd.SetStartTime(test.start)
+		cmd.SetEndTime(test.end)
+		req.SetQueryStandardValues(cmd)
+		var resps []cpint.Response = responses(srv.Handle(req))
+		if len(resps) != len(test.want) {
+			t.Errorf("[%v, %v) in chunks of %v: %v responses, want %v", test.start, test.end, test.chunkSize, len(resps), len(test.want))
+			continue
+		}
+		var last int64 = -1
+		for i, resp := range resps {
+			var records []cpint.Record = resp.Records().Values().ToArray()
+			if len(records) != test.want[i] || resp.Final() != (i == len(resps) - 1) || resp.EchoTag() != 7 || resp.Records().Version() != 2 {
+				t.Errorf("[%v, %v) response %v: %v records, final %v, echo tag %v, version %v", test.start, test.end, i, len(records), resp.Final(), resp.EchoTag(), resp.Records().Version())
+			}
+			for _, record := range records {
+				if record.Time() <= last || record.Time() < test.start || record.Time() >= test.end || record.Value() != float64(record.Time()) {
+					t.Errorf("[%v, %v): unexpected point (%v, %v)", test.start, test.end, record.Time(), record.Value())
+				}
+				last = record.Time()
+			}
+		}
+	}
+}
+
+func TestStatistical(t *testing.T) {
+	var srv *Server = NewServer()
+	insert(srv, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 17)
+
+	type window struct {
+		time int64
+		min, mean, max float64
+		count uint64
+	}
+	for _, test := range []struct {
+		statistical bool
+		start, end int64
+		width uint64 // 2^pw for statistical queries
+		want []window
+	}{
+		{true, 0, 16, 4, []window{{0, 0, 1.5, 3, 4}, {4, 4, 5.5, 7, 4}, {8, 8, 9.5, 11, 4}}},
+		{true, 1, 19, 4, []window{{0, 0, 1.5, 3, 4}, {4, 4, 5.5, 7, 4}, {8, 8, 9.5, 11, 4}}}, // [0, 16) after rounding down
+		{true, 0, 32, 16, []window{{0, 0, 5.5, 11, 12}, {16, 17, 17, 17, 1}}},
+		{false, 1, 12, 5, []window{{1, 1, 3, 5, 5}, {6, 6, 8, 10, 5}}}, // [11, 16) is not whole
+		{false, 2, 20, 6, []window{{2, 2, 4.5, 7, 6}, {8, 8, 9.5, 11, 4}, {14, 17, 17, 17, 1}}},
+	} {
+		seg, req := newRequest()
+		if test.statistical {
+			var cmd cpint.CmdQueryStatisticalValues = cpint.NewCmdQueryStatisticalValues(seg)
+			cmd.SetUuid(testUUID)
+			cmd.SetStartTime(test.start)
+			cmd.SetEndTime(test.end)
+			var pw uint8 = 0
+			for uint64(1) << pw != test.width {
+				pw++
+			}
+			cmd.SetPointWidth(pw)
+			req.SetQueryStatisticalValues(cmd)
+		} else {
+			var cmd cpint.CmdQueryWindowValues = cpint.NewCmdQueryWindowValues(seg)
+			cmd.SetUuid(testUUID)
+			cmd.SetStartTime(test.start)
+			cmd.SetEndTime(test.end)
+			cmd.SetWidth(test.width)
+			req.SetQueryWindowValues(cmd)
+		}
+		var records []cpint.StatisticalRecord = responses(srv.Handle(req))[0].StatisticalRecords().Values().ToArray()
+		var got []window
+		for _, record := range records {
+			got = append(got, window{record.Time(), record.Min(), record.Mean(), record.Max(), record.Count()})
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("statistical %v [%v, %v) width %v: got %v, want %v", test.statistical, test.start, test.end, test.width, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("statistical %v [%v, %v) width %v: got %v, want %v", test.statistical, test.start, test.end, test.width, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDeleteAndVersion(t *testing.T) {
+	var srv *Server = NewServer()
+	insert(srv, 1, 2, 3, 4, 5)
+
+	seg, req := newRequest()
+	var del cpint.CmdDeleteValues = cpint.NewCmdDeleteValues(seg)
+	del.SetUuid(testUUID)
+	del.SetStartTime(2)
+	del.SetEndTime(4)
+	req.SetDeleteValues(del)
+	if resp := responses(srv.Handle(req))[0]; resp.StatusCode() != cpint.STATUSCODE_OK || !resp.Final() {
+		t.Errorf("delete: status %v, final %v", resp.StatusCode(), resp.Final())
+	}
+	if n := srv.NumPoints(testUUID); n != 3 {
+		t.Errorf("%v points left after deleting [2, 4), want 3", n)
+	}
+
+	seg, req = newRequest()
+	var query cpint.CmdQueryVersion = cpint.NewCmdQueryVersion(seg)
+	var ids capnp.DataList = seg.NewDataList(2)
+	ids.Set(0, testUUID)
+	ids.Set(1, []byte("fedcba9876543210"))
+	query.SetUuids(ids)
+	req.SetQueryVersion(query)
+	var versions cpint.Versions = responses(srv.Handle(req))[0].VersionList()
+	if versions.Versions().Len() != 2 || versions.Versions().At(0) != 2 || versions.Versions().At(1) != 0 {
+		t.Errorf("versions %v, want [2 0]", versions.Versions())
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		var srv *Server = NewServer()
+		srv.ReplaceDuplicates = !keep
+		insert(srv, 1, 2, 2, 3)
+		insert(srv, 3, 1)
+
+		seg, req := newRequest()
+		var cmd cpint.CmdQueryStandardValues = cpint.NewCmdQueryStandardValues(seg)
+		cmd.SetUuid(testUUID)
+		cmd.SetStartTime(0)
+		cmd.SetEndTime(10)
+		req.SetQueryStandardValues(cmd)
+		var got []int64
+		for _, record := range responses(srv.Handle(req))[0].Records().Values().ToArray() {
+			got = append(got, record.Time())
+		}
+		var want []int64 = []int64{1, 2, 3}
+		if keep {
+			want = []int64{1, 1, 2, 2, 3, 3}
+		}
+		if len(got) != len(want) || srv.NumPoints(testUUID) != len(want) {
+			t.Errorf("keep duplicates %v: got %v (%v points), want %v", keep, got, srv.NumPoints(testUUID), want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("keep duplicates %v: got %v, want %v", keep, got, want)
+				break
+			}
+		}
+
+		/* Statistical records count every point. */
+		seg, req = newRequest()
+		var stat cpint.CmdQueryStatisticalValues = cpint.NewCmdQueryStatisticalValues(seg)
+		stat.SetUuid(testUUID)
+		stat.SetStartTime(0)
+		stat.SetEndTime(16)
+		stat.SetPointWidth(4)
+		req.SetQueryStatisticalValues(stat)
+		if records := responses(srv.Handle(req))[0].StatisticalRecords().Values().ToArray(); len(records) != 1 || records[0].Count() != uint64(len(want)) {
+			t.Errorf("keep duplicates %v: statistical records %v", keep, records)
+		}
+	}
+}
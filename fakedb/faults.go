@@ -0,0 +1,132 @@
+package fakedb
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* Faults makes a Server misbehave, to test how clients cope with that. The
+   "Every" faults hit every n-th response on a connection (counting from 1),
+   so which responses are hit does not depend on timing. A zero field turns
+   its fault off. To split results over several responses, use ChunkSize. */
+type Faults struct {
+	Delay time.Duration // wait this long before answering each request
+	DropAfter int // close the connection instead of sending response DropAfter + 1
+	WrongEchoTagEvery int // set the highest bit of the echo tag
+	ErrorEvery int // answer with STATUSCODE_INTERNALERROR
+	CorruptEvery int // add 1 to the first value (or mean) of a response with records
+	Reorder bool // answer a request after the one that follows it, if that arrives within ReorderWait
+}
+
+/* How long a response is held back for the next one when Faults.Reorder is set. */
+var ReorderWait time.Duration = 20 * time.Millisecond
+
+/* Sets the faults of the connections that are opened from now on. */
+func (srv *Server) SetFaults(faults Faults) {
+	srv.lock.Lock()
+	srv.faults = faults
+	srv.lock.Unlock()
+}
+
+/* Sets ChunkSize while requests may still be handled, such as those of a
+   run that was stopped. */
+func (srv *Server) SetChunkSize(size int) {
+	srv.lock.Lock()
+	srv.ChunkSize = size
+	srv.lock.Unlock()
+}
+
+/* Like serveConn, but the responses are written by a goroutine of their own
+   that applies the faults, so that reading goes on while a response is delayed
+   or held back. */
+func (srv *Server) serveFaultyConn(conn net.Conn, faults Faults) {
+	var pending chan []*capnp.Segment = make(chan []*capnp.Segment, 64)
+	var done chan struct{} = make(chan struct{})
+	go func () {
+		writeFaulty(conn, faults, pending)
+		close(done)
+	}()
+
+	var buf bytes.Buffer
+	for {
+		seg, err := capnp.ReadFromStream(conn, &buf)
+		if err != nil {
+			break
+		}
+		pending <- srv.Handle(cpint.ReadRootRequest(seg))
+	}
+	close(pending)
+	<-done
+}
+
+func writeFaulty(conn net.Conn, faults Faults, pending chan []*capnp.Segment) {
+	var sent int = 0
+	var failed bool = false
+	var write = func (segs []*capnp.Segment) {
+		for _, seg := range segs {
+			if failed {
+				return
+			}
+			sent++
+			if faults.DropAfter != 0 && sent > faults.DropAfter {
+				conn.Close()
+				failed = true
+				return
+			}
+			applyFaults(faults, sent, seg)
+			if _, err := seg.WriteTo(conn); err != nil {
+				failed = true
+			}
+		}
+	}
+
+	for segs := range pending {
+		if faults.Delay != 0 {
+			time.Sleep(faults.Delay)
+		}
+		if !faults.Reorder {
+			write(segs)
+			continue
+		}
+		var timer *time.Timer = time.NewTimer(ReorderWait)
+		select {
+		case next, ok := <-pending:
+			if ok {
+				write(next)
+			}
+			write(segs)
+		case <-timer.C:
+			write(segs)
+		}
+		timer.Stop()
+	}
+}
+
+/* Applies the faults that hit response n, which is in seg. */
+func applyFaults(faults Faults, n int, seg *capnp.Segment) {
+	var resp cpint.Response = cpint.ReadRootResponse(seg)
+	if faults.WrongEchoTagEvery != 0 && n % faults.WrongEchoTagEvery == 0 {
+		resp.SetEchoTag(resp.EchoTag() | 1 << 63)
+	}
+	if faults.ErrorEvery != 0 && n % faults.ErrorEvery == 0 {
+		resp.SetStatusCode(cpint.STATUSCODE_INTERNALERROR)
+	}
+	if faults.CorruptEvery != 0 && n % faults.CorruptEvery == 0 {
+		switch resp.Which() {
+		case cpint.RESPONSE_RECORDS:
+			var records cpint.Record_List = resp.Records().Values()
+			if records.Len() != 0 {
+				records.At(0).SetValue(records.At(0).Value() + 1)
+			}
+		case cpint.RESPONSE_STATISTICALRECORDS:
+			var records cpint.StatisticalRecord_List = resp.StatisticalRecords().Values()
+			if records.Len() != 0 {
+				records.At(0).SetMean(records.At(0).Mean() + 1)
+			}
+		}
+	}
+}
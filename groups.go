@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lilvinz/quasarloadgenerator/loadgen"
+	"github.com/pborman/uuid"
+)
+
+/* Stream groups mix streams that behave differently in one run, e.g. 120 Hz
+   PMU streams with meters that report once a minute. GROUP1, GROUP2, ... name
+   configuration files, relative to the file that lists them (to the
+   configuration file if they are set in the environment or with -set, and
+   to the current directory with -group), whose settings
+   apply on top of it for the streams of that group: NUM_STREAMS and the
+   UUIDs, NANOS_BETWEEN_POINTS, POINTS_PER_MESSAGE, FIRST_TIME,
+   TOTAL_RECORDS, DETERMINISTIC_KV or DATA_FILEs, POINTS_PER_SECOND and so on.
+   The environment and the command line still apply on top of every group.
+   Each group is named after its file and gets a runner of its own, and all of
+   them run at the same time. */
+type streamGroup struct {
+	name string
+	path string
+	config map[string]interface{}
+}
+
+/* Reads the files of the groups that config lists, if any. */
+func loadGroups(opts *runOptions, config map[string]interface{}) ([]streamGroup, bool) {
+	var groups []streamGroup
+	var names map[string]bool = make(map[string]bool)
+	_, fromFlags := opts.lists["GROUP"]
+
+	/* The overrides apply to every group, except for the groups themselves. */
+	var groupOpts runOptions = *opts
+	groupOpts.overrides = make(map[string]string)
+	groupOpts.lists = make(map[string][]string)
+	for key, value := range opts.overrides {
+		if !strings.HasPrefix(key, "GROUP") {
+			groupOpts.overrides[key] = value
+		}
+	}
+	for key, values := range opts.lists {
+		if key != "GROUP" {
+			groupOpts.lists[key] = values
+		}
+	}
+	for i := 1; i <= countList(config, "GROUP"); i++ {
+		var path string = fmt.Sprint(config[fmt.Sprintf("GROUP%v", i)])
+		if !fromFlags && !filepath.IsAbs(path) { // from the environment or -set; those from files are absolute already
+			path = filepath.Join(filepath.Dir(opts.configPath), path)
+		}
+		own, isErr := readConfigFile(path, nil)
+		if isErr {
+			return nil, true
+		}
+		if _, ok := own["GROUP1"]; ok {
+			fmt.Printf("%v: a group cannot have groups of its own\n", path)
+			return nil, true
+		}
+		var name string = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if names[name] {
+			fmt.Printf("There are two groups named %v; give their files different names\n", name)
+			return nil, true
+		}
+		names[name] = true
+
+		var merged map[string]interface{} = make(map[string]interface{})
+		mergeConfig(merged, config)
+		deleteList(merged, "GROUP")
+		mergeConfig(merged, own)
+		applyOverrides(merged, &groupOpts)
+		groups = append(groups, streamGroup{name: name, path: path, config: merged})
+	}
+	return groups, false
+}
+
+/* Reports every problem with the configurations of the groups, and returns
+   false if there are any. */
+func validateGroups(groups []streamGroup, command string) bool {
+	var valid bool = true
+	var uuids [][][]byte = make([][][]byte, len(groups))
+	for i, g := range groups {
+		var problems []configProblem = validateConfig(g.config, command)
+		if len(problems) != 0 {
+			printProblems(fmt.Sprintf("group %v (%v)", g.name, g.path), problems)
+			valid = false
+			continue
+		}
+		numStreams, _ := getIntFromConfig("NUM_STREAMS", g.config) // validated just now
+		uuids[i], _ = getStreamUUIDs(g.config, int(numStreams), false)
+	}
+	if err := checkGroupStreams(groups, uuids); err != nil {
+		fmt.Println(err)
+		valid = false
+	}
+	return valid
+}
+
+/* Two groups must not share a stream, or they would overwrite each other's
+   points. */
+func checkGroupStreams(groups []streamGroup, uuids [][][]byte) error {
+	var owners map[string]string = make(map[string]string)
+	for i, ids := range uuids {
+		for _, id := range ids {
+			var key string = uuid.UUID(id).String()
+			if owner, ok := owners[key]; ok && owner != groups[i].name {
+				return fmt.Errorf("groups %v and %v share the stream %v; give every group UUIDs of its own (e.g. a UUID_PREFIX of its own)", owner, groups[i].name, key)
+			}
+			owners[key] = groups[i].name
+		}
+	}
+	return nil
+}
+
+/* Runs the command for every group at the same time, prints a report with a
+   line for each group, and returns whether all of them passed. */
+func runGroups(ctx context.Context, command string, opts *runOptions, groups []streamGroup) bool {
+	var runners []*loadgen.Runner = make([]*loadgen.Runner, len(groups))
+	var uuids [][][]byte = make([][][]byte, len(groups))
+	for i, g := range groups {
+		cfg, err := buildRunConfig(g.name, command, g.config, opts.printAll, WRITE_UUID_FILE)
+		if err == nil {
+			cfg.StatsFile = g.name + "-stats.json"
+			if opts.recordFile != "" { // every group gets a recording of its own
+				cfg.RecordFile = filepath.Join(filepath.Dir(opts.recordFile), g.name + "-" + filepath.Base(opts.recordFile))
+			}
+			uuids[i] = cfg.UUIDS
+			runners[i], err = loadgen.NewRunner(cfg)
+		}
+		if err != nil {
+			fmt.Printf("[%v] %v\n", g.name, err)
+			return false
+		}
+	}
+	if err := checkGroupStreams(groups, uuids); err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	var results []loadgen.Result = make([]loadgen.Result, len(groups))
+	var wg sync.WaitGroup
+	for i := range runners {
+		wg.Add(1)
+		go func (i int) {
+			results[i] = runners[i].Run(ctx)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	printReport("Group", results)
+	var pass bool = true
+	for _, result := range results {
+		if result.Err != nil || !result.Pass {
+			pass = false
+		}
+	}
+	return pass
+}
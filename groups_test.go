@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* A group gets the settings of the file that lists it, then its own, then the
+   environment and the command line, but never the list of groups. */
+func TestLoadGroups(t *testing.T) {
+	var dir string = t.TempDir()
+	var path string = writeFile(t, dir, "main.ini", strings.Join([]string{
+		"TOTAL_RECORDS=1024",
+		"NANOS_BETWEEN_POINTS=1000",
+		"NUM_STREAMS=2",
+		"UUID_MODE=name",
+		"UUID_PREFIX=main-",
+		"DB_ADDR1=main:4410",
+		"GROUP1=pmu.ini",
+		"GROUP2=meters.ini",
+	}, "\n"))
+	var pmu string = writeFile(t, dir, "pmu.ini", "NANOS_BETWEEN_POINTS=8333333\nUUID_PREFIX=pmu-\n")
+	var meters string = writeFile(t, dir, "meters.ini", "NUM_STREAMS=4\nUUID_PREFIX=meters-\nDB_ADDR1=meters:4410\nTOTAL_RECORDS=4096\n")
+	t.Setenv(ENV_PREFIX + "POINTS_PER_MESSAGE", "128")
+
+	var want map[string]map[string]string = map[string]map[string]string{
+		"pmu": {
+			"TOTAL_RECORDS": "2048",
+			"NANOS_BETWEEN_POINTS": "8333333",
+			"NUM_STREAMS": "2",
+			"UUID_PREFIX": "pmu-",
+			"DB_ADDR1": "main:4410",
+			"POINTS_PER_MESSAGE": "128",
+			"SEND_MODE": "mutex",
+		},
+		"meters": {
+			"TOTAL_RECORDS": "2048",
+			"NANOS_BETWEEN_POINTS": "1000",
+			"NUM_STREAMS": "4",
+			"UUID_PREFIX": "meters-",
+			"DB_ADDR1": "meters:4410",
+			"POINTS_PER_MESSAGE": "128",
+			"SEND_MODE": "mutex",
+		},
+	}
+	for _, test := range []struct {
+		name string
+		args []string
+	}{
+		{"listed in the file", nil},
+		{"listed on the command line", []string{"-group", pmu, "-group", meters}},
+		{"set on the command line", []string{"-set", "GROUP1=pmu.ini", "-set", "GROUP2=meters.ini"}},
+	} {
+		var opts runOptions
+		newRunFlags("insert", &opts).Parse(append([]string{"-config", path, "-total-records", "2048", "-send-mode", "mutex"}, test.args...))
+		config, isErr := loadConfig(&opts)
+		if isErr {
+			t.Fatalf("%v: could not load %v", test.name, path)
+		}
+		groups, isErr := loadGroups(&opts, config)
+		if isErr || len(groups) != 2 {
+			t.Fatalf("%v: loaded %v groups", test.name, len(groups))
+		}
+		for _, g := range groups {
+			for key, value := range want[g.name] {
+				if g.config[key] != value {
+					t.Errorf("%v: group %v has %v=%v, want %v", test.name, g.name, key, g.config[key], value)
+				}
+			}
+			if n := countList(g.config, "GROUP"); n != 0 {
+				t.Errorf("%v: group %v lists %v groups of its own", test.name, g.name, n)
+			}
+		}
+		if !validateGroups(groups, "insert") {
+			t.Errorf("%v: the groups are not valid", test.name)
+		}
+	}
+
+	/* Groups listed in an included file are relative to that file. */
+	var base string = t.TempDir()
+	writeFile(t, base, "base.ini", "UUID_MODE=name\nDB_ADDR1=main:4410\nGROUP1=pmu.ini\nGROUP2=meters.ini\n")
+	writeFile(t, base, "pmu.ini", "UUID_PREFIX=pmu-\n")
+	writeFile(t, base, "meters.ini", "UUID_PREFIX=meters-\nNUM_STREAMS=4\n")
+	var including string = writeFile(t, t.TempDir(), "main.ini", "INCLUDE=" + filepath.Join(base, "base.ini") + "\nTOTAL_RECORDS=8192\n")
+	var opts runOptions
+	newRunFlags("insert", &opts).Parse([]string{"-config", including})
+	config, isErr := loadConfig(&opts)
+	if isErr {
+		t.Fatalf("could not load %v", including)
+	}
+	if groups, isErr := loadGroups(&opts, config); isErr || len(groups) != 2 || groups[1].path != filepath.Join(base, "meters.ini") || groups[1].config["NUM_STREAMS"] != "4" || groups[1].config["TOTAL_RECORDS"] != "8192" {
+		t.Errorf("groups of an included file: %+v", groups)
+	}
+
+	/* Groups that cannot run together. */
+	for _, test := range []struct {
+		name string
+		groups string
+		files map[string]string
+	}{
+		{"nested", "GROUP1=a.ini\nGROUP2=b.ini\n", map[string]string{"a.ini": "GROUP1=b.ini\n", "b.ini": "UUID_PREFIX=b-\n"}},
+		{"same name", "GROUP1=a.ini\nGROUP2=sub/a.ini\n", map[string]string{"a.ini": "UUID_PREFIX=a-\n", "sub/a.ini": "UUID_PREFIX=b-\n"}},
+		{"missing", "GROUP1=a.ini\nGROUP2=b.ini\n", map[string]string{"a.ini": "UUID_PREFIX=a-\n"}},
+		{"shared streams", "GROUP1=a.ini\nGROUP2=b.ini\n", map[string]string{"a.ini": "NUM_STREAMS=2\n", "b.ini": "NUM_STREAMS=3\n"}},
+	} {
+		var sub string = t.TempDir()
+		if err := os.Mkdir(filepath.Join(sub, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range test.files {
+			writeFile(t, sub, name, contents)
+		}
+		var opts runOptions
+		newRunFlags("insert", &opts).Parse([]string{"-config", writeFile(t, sub, "main.ini", "UUID_MODE=name\nDB_ADDR1=main:4410\n" + test.groups)})
+		config, isErr := loadConfig(&opts)
+		if isErr {
+			t.Fatalf("%v: could not load the configuration", test.name)
+		}
+		if groups, isErr := loadGroups(&opts, config); !isErr && validateGroups(groups, "insert") {
+			t.Errorf("%v: the groups are valid", test.name)
+		}
+	}
+}
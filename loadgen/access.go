@@ -0,0 +1,217 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+/* A QueryAccess makes queries look more like those of dashboards, which ask
+   for recent data and a few hot streams far more often than for the rest.
+   Its zero value queries every message of every stream once, in the order
+   that PERM_SEED gives. Otherwise the streams still send as many queries
+   in total, but each query picks its place from the distributions below,
+   drawn from PERM_SEED so that a run can be repeated. Queries always start
+   at the start of a message and cover whole messages, so their responses can
+   still be verified. */
+type QueryAccess struct {
+	/* The query workers of the streams send queries in proportion to
+	   1 / rank ^ StreamSkew (a Zipf distribution), where the ranks of the
+	   streams are shuffled; 0 queries all streams equally. */
+	StreamSkew float64
+
+	/* RecentQueries of the queries ask for the last RecentSpan of the time
+	   that the streams cover, e.g. 0.8 and 0.1. */
+	RecentQueries float64
+	RecentSpan float64
+
+	/* HotspotQueries of the queries ask for one of Hotspots ranges, each
+	   HotspotWidth of the time that the streams cover, at random places
+	   that all streams share. */
+	Hotspots int64
+	HotspotWidth float64
+	HotspotQueries float64
+
+	/* Each query covers between MinWindow and MaxWindow messages, chosen
+	   uniformly; 0 covers one. */
+	MinWindow int64
+	MaxWindow int64
+}
+
+/* Parses a QUERY_ACCESS, a comma separated list of
+     zipf=<skew>
+     recent=<fraction of the queries>/<fraction of the time>
+     hotspots=<count>/<fraction of the time each>/<fraction of the queries>
+     window=<min messages>/<max messages>
+   e.g. "zipf=1.1, recent=0.8/0.1". An empty string or "none" is the zero
+   QueryAccess. */
+func ParseQueryAccess(value string) (QueryAccess, error) {
+	var a QueryAccess
+	if strings.TrimSpace(value) == "none" {
+		return a, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var kv []string = strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return a, fmt.Errorf("expected <name>=<values>, got %q", part)
+		}
+		var args []string = strings.Split(kv[1], "/")
+		var ints []int64
+		var floats []float64
+		var err error
+		switch kv[0] {
+		case "zipf":
+			floats, err = parsePatternFloats(args, 1)
+			if err == nil {
+				a.StreamSkew = floats[0]
+			}
+		case "recent":
+			floats, err = parsePatternFloats(args, 2)
+			if err == nil {
+				a.RecentQueries, a.RecentSpan = floats[0], floats[1]
+				if a.RecentSpan == 0 || a.RecentSpan > 1 {
+					err = fmt.Errorf("the fraction of the time must be more than 0 and at most 1")
+				}
+			}
+		case "hotspots":
+			if len(args) == 3 {
+				ints, err = parsePatternInts(args[:1], 1)
+				if err == nil {
+					floats, err = parsePatternFloats(args[1:], 2)
+				}
+			} else {
+				err = fmt.Errorf("expected 3 values separated by /")
+			}
+			if err == nil {
+				a.Hotspots, a.HotspotWidth, a.HotspotQueries = ints[0], floats[0], floats[1]
+				if a.HotspotWidth == 0 || a.HotspotWidth > 1 {
+					err = fmt.Errorf("the fraction of the time must be more than 0 and at most 1")
+				}
+			}
+		case "window":
+			ints, err = parsePatternInts(args, 2)
+			if err == nil {
+				a.MinWindow, a.MaxWindow = ints[0], ints[1]
+				if a.MinWindow > a.MaxWindow {
+					err = fmt.Errorf("the minimum is more than the maximum")
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown (expected zipf, recent, hotspots or window)")
+		}
+		if err != nil {
+			return a, fmt.Errorf("%v: %v", kv[0], err)
+		}
+	}
+	if a.RecentQueries + a.HotspotQueries > 1 {
+		return a, fmt.Errorf("recent and hotspots together get more than all queries")
+	}
+	return a, nil
+}
+
+func (a QueryAccess) IsZero() bool {
+	return a == QueryAccess{}
+}
+
+/* Returns how many of numQueries queries each of numStreams streams sends. */
+func (a QueryAccess) streamQueries(numStreams int, numQueries int64, permGen *rand.Rand) []int64 {
+	var counts []int64 = make([]int64, numStreams)
+	var ranks []int = permGen.Perm(numStreams)
+	var weights []float64 = make([]float64, numStreams)
+	var total float64 = 0
+	for s := range weights {
+		weights[s] = math.Pow(float64(ranks[s] + 1), -a.StreamSkew)
+		total += weights[s]
+	}
+	var left int64 = numQueries
+	for s := range counts {
+		counts[s] = int64(float64(numQueries) * weights[s] / total)
+		left -= counts[s]
+	}
+	/* What rounding down left over goes to the hottest streams. */
+	for rank := 0; left > 0; rank = (rank + 1) % numStreams {
+		for s := range ranks {
+			if ranks[s] == rank {
+				counts[s]++
+				left--
+			}
+		}
+	}
+	return counts
+}
+
+/* Returns the start times and lengths in ns of n queries of a stream that
+   holds numMessages messages. hotspots holds the first message of every
+   hotspot. */
+func (a QueryAccess) queries(n int64, numMessages int64, messageLength int64, firstTime int64, hotspots []int64, permGen *rand.Rand) ([]int64, []int64) {
+	var starts []int64 = make([]int64, n)
+	var spans []int64 = make([]int64, n)
+	var hotWidth int64 = int64(math.Ceil(a.HotspotWidth * float64(numMessages)))
+	var recentWidth int64 = int64(math.Ceil(a.RecentSpan * float64(numMessages)))
+	for q := range starts {
+		var window int64 = 1
+		if a.MaxWindow != 0 {
+			window = a.MinWindow + permGen.Int63n(a.MaxWindow - a.MinWindow + 1)
+			if window > numMessages {
+				window = numMessages
+			}
+		}
+		/* The query starts in [lo, hi], but must end by the last message. */
+		var lo, hi int64 = 0, numMessages - 1
+		var u float64 = permGen.Float64()
+		switch {
+		case u < a.RecentQueries:
+			lo = numMessages - recentWidth
+		case u < a.RecentQueries + a.HotspotQueries:
+			lo = hotspots[permGen.Intn(len(hotspots))]
+			hi = lo + hotWidth - 1
+		}
+		if hi > numMessages - window {
+			hi = numMessages - window
+		}
+		if lo > hi {
+			lo = hi
+		}
+		starts[q] = firstTime + messageLength * (lo + permGen.Int63n(hi - lo + 1))
+		spans[q] = messageLength * window
+	}
+	return starts, spans
+}
+
+/* Sets the messages of the query workers of a run with QUERY_ACCESS: a worker
+   z that queries gets starts[z] and spans[z], and is left alone otherwise. */
+func (r *Runner) queryAccess(permGen *rand.Rand, numMessages int64, starts [][]int64, spans [][]int64) {
+	var a QueryAccess = r.QUERY_ACCESS
+	var counts []int64 = a.streamQueries(r.NUM_STREAMS, numMessages * int64(r.NUM_STREAMS), permGen)
+	var hotspots []int64 = make([]int64, a.Hotspots)
+	for h := range hotspots {
+		hotspots[h] = permGen.Int63n(numMessages)
+	}
+	var messageLength int64 = r.NANOS_BETWEEN_POINTS * int64(r.POINTS_PER_MESSAGE)
+	for z := range starts {
+		if isQueryWorkload(r.workloads[z / r.NUM_STREAMS]) {
+			starts[z], spans[z] = a.queries(counts[z % r.NUM_STREAMS], numMessages, messageLength, r.FIRST_TIME, hotspots, permGen)
+		}
+	}
+}
+
+func isQueryWorkload(w Workload) bool {
+	switch w.(type) {
+	case standQueryWorkload, statQueryWorkload, dataQueryWorkload:
+		return true
+	}
+	return false
+}
+
+/* The ns that message j of a stream covers. */
+func (r *Runner) messageSpan(stream Stream, j uint64) int64 {
+	if stream.Spans != nil {
+		return stream.Spans[j]
+	}
+	return r.NANOS_BETWEEN_POINTS * int64(r.POINTS_PER_MESSAGE)
+}
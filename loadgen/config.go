@@ -0,0 +1,420 @@
+/* Package loadgen generates load on BTrDB (Quasar) servers: it inserts,
+   queries, verifies, deletes or flushes points in a set of streams as quickly
+   as possible, or at a given rate, and reports how long that took.
+
+   A test suite can drive it directly:
+
+	var cfg loadgen.Config = loadgen.DefaultConfig()
+	cfg.Command = "insert"
+	cfg.DB_ADDRS = []string{"localhost:4410"}
+	cfg.UUIDS = [][]byte{uuid.NewRandom()}
+	runner, err := loadgen.NewRunner(cfg)
+	...
+	var result loadgen.Result = runner.Run(ctx)
+
+   The settings have the names of the keys of the configuration file of the
+   quasarloadgenerator command, which is a thin wrapper around this package. */
+package loadgen
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/* The commands that a Runner can run. */
+var Commands []string = []string{"insert", "query", "verify", "delete", "flush", "mixed"}
+
+/* Config describes a run. See the README of quasarloadgenerator for the
+   meaning of each setting. */
+type Config struct {
+	Name string // printed before every line of output, if set
+	Command string // one of Commands
+	PRINT_ALL bool // print every point that is verified
+	StatsFile string // where GET_MESSAGE_TIMES writes the message times
+	RecordFile string // if set, every request is recorded to this file, for Replay
+
+	DB_ADDRS []string
+	UUIDS [][]byte // the streams, as 16 byte UUIDs
+
+	TOTAL_RECORDS int64
+	TCP_CONNECTIONS int
+	CONN_ASSIGNMENT string // one of ConnAssignments
+	SEND_MODE string // one of SendModes
+	ROUTING string // one of RoutingModes
+	VIRTUAL_NODES int
+	ROUTES map[string]string // UUID (in any form that uuid.Parse takes) to DB_ADDR, for ROUTING "map"
+	POINTS_PER_MESSAGE uint32
+	NANOS_BETWEEN_POINTS int64
+	MAX_TIME_RANDOM_OFFSET int64
+	FIRST_TIME int64
+	MAX_CONCURRENT_MESSAGES uint64
+	RAND_SEED int64
+	PERM_SEED int64
+	DETERMINISTIC_KV bool
+	GET_MESSAGE_TIMES bool
+	STATISTICAL_PW int // -1 makes standard queries
+	POINTS_PER_SECOND int64
+	DURATION time.Duration
+	VERIFY_RESPONSES bool // check every response with its workload; always set for Command "verify"
+
+	/* If set, the streams insert and query the points of these files (see
+	   ReadSeries) instead of generated ones, taking turns if there are fewer
+	   files than streams. Only standard queries are supported. */
+	DataFiles []string
+	DATA_TIME_SHIFT bool // move the points of each file so that they start at FIRST_TIME
+	DATA_LOOP bool // repeat the points of a file that has fewer than TOTAL_RECORDS
+
+	/* If not zero, the streams insert and query points with these irregular
+	   times instead of one every NANOS_BETWEEN_POINTS. Only standard queries
+	   are supported. */
+	TIME_PATTERN TimePattern
+	DUPLICATES string // one of DuplicatePolicies; what the database does with points at the same time
+
+	/* If not zero, queries favour some streams and times over others, and
+	   may cover several messages. */
+	QUERY_ACCESS QueryAccess
+
+	/* If not zero, every query covers a span and, if statistical, has a
+	   point width of its own. */
+	QUERY_RANGES QueryRanges
+
+	/* If set, every stream gets a worker for each of these instead of the
+	   workloads of Command, which then only names the run. */
+	Workloads []Workload
+}
+
+/* Returns a Config with the same defaults as the configuration file. */
+func DefaultConfig() Config {
+	return Config{
+		StatsFile: "stats.json",
+		TOTAL_RECORDS: 16777216,
+		TCP_CONNECTIONS: 1,
+		CONN_ASSIGNMENT: "roundrobin",
+		SEND_MODE: "batch",
+		ROUTING: "modulo",
+		VIRTUAL_NODES: 64,
+		POINTS_PER_MESSAGE: 4096,
+		NANOS_BETWEEN_POINTS: 1048576,
+		FIRST_TIME: 1420582217226125312,
+		MAX_CONCURRENT_MESSAGES: 4,
+		RAND_SEED: 15,
+		STATISTICAL_PW: -1,
+		DUPLICATES: "keep",
+	}
+}
+
+/* The outcome of a run. */
+type Result struct {
+	Name string
+	Command string
+	Points uint64 // points inserted, queried or deleted
+	Verified uint64 // points verified to be correct
+	Pass bool // false if verification failed or the run did not finish
+	Cancelled bool // the context was cancelled before the run finished
+	Duration time.Duration
+	PointWidths []PointWidthStats // for every point width queried, with point widths in QUERY_RANGES
+	Health HealthStats // what the generator itself spent its time on, unless deleting or flushing
+	Err error // what stopped the run, if anything but the context
+}
+
+func contains(list []string, str string) bool {
+	for _, elem := range list {
+		if elem == str {
+			return true
+		}
+	}
+	return false
+}
+
+/* A problem with a Config, for the setting Key if there is one, and how to
+   fix it if we know. */
+type ConfigError struct {
+	Key string
+	Message string
+	Fix string
+}
+
+func (e ConfigError) Error() string {
+	if e.Key == "" {
+		return e.Message
+	}
+	return e.Key + ": " + e.Message
+}
+
+/* Returns every problem with the Config: settings that are out of range or
+   cannot be used together, and what would make a run send messages that it
+   cannot tell apart, or expect points that the inserts never made.
+   NewRunner refuses a Config with any of them; the validate command of
+   quasarloadgenerator reports them all. */
+func (cfg Config) Check() []ConfigError {
+	var problems []ConfigError
+	var report = func (key string, fix string, format string, args ...interface{}) {
+		problems = append(problems, ConfigError{key, fmt.Sprintf(format, args...), fix})
+	}
+	var verify bool = (cfg.Command == "verify" || cfg.VERIFY_RESPONSES) && len(cfg.Workloads) == 0
+	var generated bool = len(cfg.DataFiles) == 0 && cfg.TIME_PATTERN.IsZero()
+	var querying bool = len(cfg.Workloads) == 0 && (cfg.Command == "query" || cfg.Command == "verify" || cfg.Command == "mixed")
+
+	if len(cfg.Workloads) == 0 && !contains(Commands, cfg.Command) {
+		report("", "use one of the commands " + strings.Join(Commands, ", ") + ", or give the Config Workloads", "unknown command %q", cfg.Command)
+	} else if len(cfg.Workloads) != 0 && (cfg.Command == "delete" || cfg.Command == "flush") {
+		report("", "leave Workloads empty, or use another command", "the %v command does not take Workloads", cfg.Command)
+	}
+	if len(cfg.DB_ADDRS) == 0 {
+		report("DB_ADDR", "list the servers as DB_ADDR1, DB_ADDR2, ...", "no servers to send to")
+	}
+	if len(cfg.UUIDS) == 0 {
+		report("UUID", "list the streams as UUID1, UUID2, ..., or use another UUID_MODE", "no streams to send")
+	}
+	for i, id := range cfg.UUIDS {
+		if len(id) != 16 {
+			report(fmt.Sprintf("UUID%v", i + 1), "use the form 9f67541c-95ee-11e4-a7ac-0026b6df9cf2", "is %v bytes long, not 16", len(id))
+		}
+	}
+	for _, setting := range []struct {
+		key string
+		value int64
+	}{
+		{"TOTAL_RECORDS", cfg.TOTAL_RECORDS},
+		{"TCP_CONNECTIONS", int64(cfg.TCP_CONNECTIONS)},
+		{"POINTS_PER_MESSAGE", int64(cfg.POINTS_PER_MESSAGE)},
+		{"NANOS_BETWEEN_POINTS", cfg.NANOS_BETWEEN_POINTS},
+		{"MAX_CONCURRENT_MESSAGES", int64(cfg.MAX_CONCURRENT_MESSAGES)},
+		{"VIRTUAL_NODES", int64(cfg.VIRTUAL_NODES)},
+	} {
+		if setting.value <= 0 {
+			report(setting.key, fmt.Sprintf("set %v to a positive number", setting.key), "must be positive, got %v", setting.value)
+		}
+	}
+	if cfg.POINTS_PER_SECOND < 0 {
+		report("POINTS_PER_SECOND", "set POINTS_PER_SECOND to 0 to send as fast as possible", "must be nonnegative, got %v", cfg.POINTS_PER_SECOND)
+	}
+	if cfg.DURATION < 0 {
+		report("DURATION", "set DURATION to a duration like 90s or 10m, or to 0", "must be nonnegative, got %v", cfg.DURATION)
+	}
+	if cfg.STATISTICAL_PW < -1 || cfg.STATISTICAL_PW > 63 {
+		report("STATISTICAL_PW", "use -1 for standard queries or a point width between 0 and 63", "out of range: %v", cfg.STATISTICAL_PW)
+	}
+	for _, setting := range []struct {
+		key string
+		value string
+		choices []string
+	}{
+		{"CONN_ASSIGNMENT", cfg.CONN_ASSIGNMENT, ConnAssignments},
+		{"SEND_MODE", cfg.SEND_MODE, SendModes},
+		{"ROUTING", cfg.ROUTING, RoutingModes},
+	} {
+		if !contains(setting.choices, setting.value) {
+			report(setting.key, fmt.Sprintf("set %v to one of %v", setting.key, strings.Join(setting.choices, ", ")), "unknown value %q", setting.value)
+		}
+	}
+	if cfg.DUPLICATES != "" && !contains(DuplicatePolicies, cfg.DUPLICATES) { // "" is "keep"
+		report("DUPLICATES", fmt.Sprintf("set DUPLICATES to one of %v", strings.Join(DuplicatePolicies, ", ")), "unknown value %q", cfg.DUPLICATES)
+	}
+
+	if len(cfg.DataFiles) != 0 && !cfg.TIME_PATTERN.IsZero() {
+		report("TIME_PATTERN", "set TIME_PATTERN=none or remove the DATA_FILEs", "cannot be used with DATA_FILEs")
+	}
+	if len(cfg.DataFiles) != 0 && cfg.STATISTICAL_PW >= 0 && querying {
+		report("STATISTICAL_PW", "set STATISTICAL_PW=-1", "statistical queries of DATA_FILEs are not supported")
+	}
+	if !cfg.TIME_PATTERN.IsZero() && cfg.STATISTICAL_PW >= 0 && querying {
+		report("STATISTICAL_PW", "set STATISTICAL_PW=-1", "statistical queries with a TIME_PATTERN are not supported")
+	}
+	if !cfg.QUERY_ACCESS.IsZero() && (cfg.Command == "verify" || cfg.VERIFY_RESPONSES) && !cfg.DETERMINISTIC_KV && generated {
+		report("QUERY_ACCESS", "set DETERMINISTIC_KV=true both when inserting and verifying, or QUERY_ACCESS=none", "verifying queries with a QUERY_ACCESS needs deterministic points")
+	}
+	if !cfg.QUERY_RANGES.IsZero() && (cfg.Command == "verify" || cfg.VERIFY_RESPONSES) {
+		report("QUERY_RANGES", "use the query command, or set QUERY_RANGES=none", "the responses to queries with QUERY_RANGES cannot be verified")
+	} else if !cfg.QUERY_RANGES.IsZero() && !generated {
+		report("QUERY_RANGES", "set QUERY_RANGES=none, or remove the DATA_FILEs and TIME_PATTERN", "cannot be used with DATA_FILEs or a TIME_PATTERN")
+	}
+
+	if cfg.MAX_TIME_RANDOM_OFFSET < 0 {
+		report("MAX_TIME_RANDOM_OFFSET", "set MAX_TIME_RANDOM_OFFSET to 0 for evenly spaced points", "must be nonnegative, got %v", cfg.MAX_TIME_RANDOM_OFFSET)
+	} else if cfg.MAX_TIME_RANDOM_OFFSET > (1 << 53) { // must be exactly representable as a float64
+		report("MAX_TIME_RANDOM_OFFSET", "set MAX_TIME_RANDOM_OFFSET to at most 2 ^ 53", "is too large: %v", cfg.MAX_TIME_RANDOM_OFFSET)
+	} else if cfg.NANOS_BETWEEN_POINTS > 0 && cfg.MAX_TIME_RANDOM_OFFSET >= cfg.NANOS_BETWEEN_POINTS {
+		report("MAX_TIME_RANDOM_OFFSET", fmt.Sprintf("set MAX_TIME_RANDOM_OFFSET to at most %v", cfg.NANOS_BETWEEN_POINTS - 1), "must be less than NANOS_BETWEEN_POINTS (%v), got %v", cfg.NANOS_BETWEEN_POINTS, cfg.MAX_TIME_RANDOM_OFFSET)
+	}
+
+	/* The points of data files and time patterns are the same whatever the
+	   order. */
+	if verify && generated && cfg.PERM_SEED != 0 && !cfg.DETERMINISTIC_KV {
+		report("PERM_SEED", "set PERM_SEED=0, or set DETERMINISTIC_KV=true both when inserting and verifying", "must be 0 when verifying nondeterministic responses")
+	}
+	if verify && cfg.QUERY_RANGES.IsZero() && cfg.STATISTICAL_PW >= 0 && cfg.STATISTICAL_PW <= 63 && cfg.POINTS_PER_MESSAGE != 0 {
+		var lower int64 = (int64(1) << uint(cfg.STATISTICAL_PW)) - 1
+		var nanosPerMessage int64 = cfg.NANOS_BETWEEN_POINTS * int64(cfg.POINTS_PER_MESSAGE)
+		if nanosPerMessage & lower != 0 {
+			report("STATISTICAL_PW", fmt.Sprintf("choose NANOS_BETWEEN_POINTS and POINTS_PER_MESSAGE so that their product is a multiple of %v, or lower STATISTICAL_PW", lower + 1), "when verifying statistical responses, NANOS_BETWEEN_POINTS * POINTS_PER_MESSAGE (%v, the ns in each query) must be a multiple of 2 ^ STATISTICAL_PW", nanosPerMessage)
+		}
+		if cfg.FIRST_TIME & lower != 0 {
+			report("FIRST_TIME", fmt.Sprintf("set FIRST_TIME to %v", cfg.FIRST_TIME &^ lower), "when verifying statistical responses, FIRST_TIME must be a multiple of 2 ^ STATISTICAL_PW")
+		}
+	}
+
+	/* The echo tag of a message holds the index of its worker and of the
+	   message (see setNumMessages). */
+	if cfg.TOTAL_RECORDS > 0 && cfg.POINTS_PER_MESSAGE != 0 && len(cfg.UUIDS) != 0 && cfg.Command != "delete" && cfg.Command != "flush" {
+		var numMessages int64 = (cfg.TOTAL_RECORDS + int64(cfg.POINTS_PER_MESSAGE) - 1) / int64(cfg.POINTS_PER_MESSAGE)
+		var numWorkloads int = len(cfg.Workloads)
+		if numWorkloads == 0 {
+			numWorkloads = 1
+			if cfg.Command == "mixed" {
+				numWorkloads = 2
+			}
+		}
+		var numWorkers int64 = int64(len(cfg.UUIDS) * numWorkloads)
+		if !cfg.QUERY_ACCESS.IsZero() {
+			numMessages *= int64(len(cfg.UUIDS)) // the hottest stream may get every query
+		}
+		if bitLength(numMessages - 1) + bitLength(numWorkers - 1) > 64 {
+			report("", "use fewer messages per stream (raise POINTS_PER_MESSAGE or lower TOTAL_RECORDS) or fewer streams", "echo tags need %v bits for the message number and %v bits for the worker, but only 64 are available", bitLength(numMessages - 1), bitLength(numWorkers - 1))
+		}
+	}
+	return problems
+}
+
+/* Checks the Config and sets up a run. This is not as thorough as the
+   validate command of quasarloadgenerator, but catches what would make the
+   run misbehave, and returns the first problem that Check finds. */
+func NewRunner(cfg Config) (*Runner, error) {
+	if problems := cfg.Check(); len(problems) != 0 {
+		return nil, problems[0]
+	}
+
+	var r *Runner = &Runner{Config: cfg}
+	r.NUM_SERVERS = len(cfg.DB_ADDRS)
+	r.NUM_STREAMS = len(cfg.UUIDS)
+	r.insertPool.New = r.newInsertMessagePart
+	r.standQueryPool.New = r.newQueryMessagePart
+	r.statQueryPool.New = r.newStatQueryMessagePart
+
+	var queryMode bool = false
+	switch cfg.Command {
+	case "insert":
+		r.workloads = []Workload{insertWorkload{r}}
+	case "query":
+		queryMode = true
+	case "verify":
+		r.VERIFY_RESPONSES = true
+		queryMode = true
+	case "delete":
+		r.DELETE_POINTS = true
+		r.workloads = []Workload{deleteWorkload{r}}
+	case "flush":
+		r.FLUSH_STREAMS = true
+		r.workloads = []Workload{flushWorkload{r}}
+	case "mixed":
+		queryMode = true
+		r.workloads = []Workload{insertWorkload{r}}
+	}
+	if queryMode {
+		if cfg.QUERY_RANGES.MaxPW != 0 {
+			r.pw = uint8(cfg.QUERY_RANGES.MinPW)
+			r.statistical = true
+			r.workloads = append(r.workloads, statQueryWorkload{r})
+		} else if cfg.STATISTICAL_PW >= 0 {
+			r.pw = uint8(cfg.STATISTICAL_PW)
+			r.statistical = true
+			r.statisticalBitmaskLower = (int64(1) << uint(r.pw)) - 1
+			r.statisticalBitmaskUpper = ^r.statisticalBitmaskLower
+			r.workloads = append(r.workloads, statQueryWorkload{r})
+		} else {
+			r.statistical = false
+			r.workloads = append(r.workloads, standQueryWorkload{r})
+		}
+	}
+	if r.DETERMINISTIC_KV {
+		r.get_time_value = r.getSinusoidValue;
+	} else {
+		r.get_time_value = getRandValue;
+	}
+	if len(cfg.DataFiles) != 0 {
+		if err := r.loadData(); err != nil {
+			return nil, err
+		}
+	} else if !cfg.TIME_PATTERN.IsZero() {
+		r.generatePattern()
+	}
+	if r.data != nil {
+		for i, w := range r.workloads {
+			switch w.(type) {
+			case insertWorkload:
+				r.workloads[i] = dataInsertWorkload{r}
+			case standQueryWorkload:
+				r.workloads[i] = dataQueryWorkload{r}
+			}
+		}
+	}
+	if len(cfg.Workloads) != 0 {
+		r.workloads = cfg.Workloads
+	}
+	if r.VERIFY_RESPONSES && r.MAX_CONCURRENT_MESSAGES != 1 {
+		r.printf("WARNING: MAX_CONCURRENT_MESSAGES is always 1 when verifying responses.\n")
+		r.MAX_CONCURRENT_MESSAGES = 1
+	}
+	/* The points that replace others are known only if the server gets the
+	   messages in the order in which they are sent. */
+	if r.duplicatePolicy() == "replace" && r.MAX_CONCURRENT_MESSAGES > 1 && r.insertsCrossingDuplicates() {
+		return nil, ConfigError{"MAX_CONCURRENT_MESSAGES", "must be 1 with DUPLICATES=replace when points at the same time are in different messages, which could reach the server out of order", "set MAX_CONCURRENT_MESSAGES=1"}
+	}
+
+	var err error
+	if r.ROUTES != nil {
+		if r.ROUTES, err = normalizeRoutes(r.ROUTES); err != nil {
+			return nil, err
+		}
+	}
+	r.streamServers, err = routeStreams(r.Config)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/* Prints what the run is going to do. */
+func (r *Runner) describe() {
+	if len(r.DataFiles) != 0 {
+		r.printf("Using the points in %v\n", strings.Join(r.DataFiles, ", "))
+	} else if r.data != nil {
+		r.printf("Using the time pattern %+v, with duplicates %v\n", r.TIME_PATTERN, r.duplicatePolicy())
+	}
+	if !r.QUERY_ACCESS.IsZero() {
+		r.printf("Query access: %+v\n", r.QUERY_ACCESS)
+	}
+	if !r.QUERY_RANGES.IsZero() {
+		r.printf("Query ranges: %+v\n", r.QUERY_RANGES)
+	}
+	if len(r.Config.Workloads) != 0 {
+		var names []string
+		for _, w := range r.workloads {
+			names = append(names, w.Name())
+		}
+		r.printf("Workloads: %v\n", strings.Join(names, ", "))
+		if r.VERIFY_RESPONSES {
+			r.printf("Verifying responses\n")
+		}
+		return
+	}
+	switch r.Command {
+	case "insert":
+		r.printf("Insert mode\n");
+	case "query":
+		r.printf("Query mode\n");
+	case "verify":
+		if r.PRINT_ALL {
+			r.printf("Query mode with \"print all\" verification\n");
+		} else {
+			r.printf("Query mode with verification\n");
+		}
+	case "delete":
+		r.printf("Delete mode\n")
+	case "flush":
+		r.printf("Flush mode\n")
+	case "mixed":
+		r.printf("Mixed insert and query mode\n")
+	}
+}
@@ -0,0 +1,100 @@
+package loadgen
+
+import (
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+/* CONN_ASSIGNMENT selects which connection to its server each worker uses:
+     roundrobin   the streams of a server take turns over its TCP_CONNECTIONS
+                  connections (what we always did)
+     perstream    every stream gets a connection of its own; TCP_CONNECTIONS is ignored
+     leastloaded  each worker goes to the connection that has the fewest points to
+                  move so far
+     dedicated    in mixed mode, inserts and queries each get TCP_CONNECTIONS
+                  connections of their own, so they do not queue behind each other
+   Only connections that some worker uses are dialed. */
+var ConnAssignments []string = []string{"roundrobin", "perstream", "leastloaded", "dedicated"}
+
+/* Returns the index of the connection of every worker and the number of
+   connections needed to each server. Worker z works on stream
+   z % NUM_STREAMS with workload z / NUM_STREAMS, and moves workerPoints[z] points. */
+func (r *Runner) assignConnections(numWorkers int, workerPoints []int64) ([]int, []int) {
+	var conns []int = make([]int, numWorkers)
+	var numConns []int = make([]int, r.NUM_SERVERS)
+	var streamCounts [][]int = make([][]int, r.NUM_SERVERS)
+	var loads [][]int64 = make([][]int64, r.NUM_SERVERS)
+	var streamConns []int = make([]int, r.NUM_STREAMS)
+	for s := range streamCounts {
+		streamCounts[s] = make([]int, numWorkers / r.NUM_STREAMS)
+		loads[s] = make([]int64, r.TCP_CONNECTIONS)
+	}
+	for z := 0; z < numWorkers; z++ {
+		var stream int = z % r.NUM_STREAMS
+		var sender int = z / r.NUM_STREAMS
+		var serverIndex int = r.getServer(stream)
+		switch r.CONN_ASSIGNMENT {
+		case "roundrobin":
+			conns[z] = streamCounts[serverIndex][0] % r.TCP_CONNECTIONS
+			streamCounts[serverIndex][0]++
+		case "perstream":
+			if sender == 0 {
+				streamConns[stream] = streamCounts[serverIndex][0]
+				streamCounts[serverIndex][0]++
+			}
+			conns[z] = streamConns[stream]
+		case "leastloaded":
+			var best int = 0
+			for c := range loads[serverIndex] {
+				if loads[serverIndex][c] < loads[serverIndex][best] {
+					best = c
+				}
+			}
+			loads[serverIndex][best] += workerPoints[z]
+			conns[z] = best
+		case "dedicated":
+			conns[z] = sender * r.TCP_CONNECTIONS + streamCounts[serverIndex][sender] % r.TCP_CONNECTIONS
+			streamCounts[serverIndex][sender]++
+		}
+		if conns[z] >= numConns[serverIndex] {
+			numConns[serverIndex] = conns[z] + 1
+		}
+	}
+	return conns, numConns
+}
+
+/* Prints which workers use which connection. */
+func (r *Runner) printAssignment(conns []int, numConns []int, workerNames []string) {
+	var names [][][]string = make([][][]string, r.NUM_SERVERS)
+	for s := range names {
+		names[s] = make([][]string, numConns[s])
+	}
+	for z, c := range conns {
+		var s int = r.getServer(z % r.NUM_STREAMS)
+		names[s][c] = append(names[s][c], workerNames[z])
+	}
+	r.printf("%-32s %6s %8s  %s\n", "Server", "Conn", "Workers", "Streams")
+	for s, addr := range r.DB_ADDRS {
+		for c, workers := range names[s] {
+			if len(workers) == 0 {
+				continue
+			}
+			var count int = len(workers)
+			if count > 3 {
+				workers = append(workers[:3], "...")
+			}
+			r.printf("%-32s %6d %8d  %s\n", addr, c, count, strings.Join(workers, ", "))
+		}
+	}
+}
+
+/* Labels a worker with the UUID of its stream and, if the run has more than
+   one workload (like mixed mode), the name of its workload. */
+func (r *Runner) workerName(z int) string {
+	var name string = uuid.UUID(r.UUIDS[z % r.NUM_STREAMS]).String()
+	if len(r.workloads) > 1 {
+		name += " " + r.workloads[z / r.NUM_STREAMS].Name()
+	}
+	return name
+}
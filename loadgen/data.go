@@ -0,0 +1,425 @@
+package loadgen
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* The points of a stream, read from a data file, in time order. */
+type Series struct {
+	Times []int64
+	Values []float64
+}
+
+/* Reads a data file. A file whose name ends in .bin holds a point every 16
+   bytes: the time in nanoseconds (int64) and the value (float64), both little
+   endian. Any other file is CSV with a "time,value" line per point, where the
+   time is in nanoseconds; empty lines, lines starting with # and a header line
+   are skipped. The times must increase strictly. */
+func ReadSeries(path string) (*Series, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var reader *bufio.Reader = bufio.NewReaderSize(file, 1 << 20)
+	var series *Series
+	if strings.HasSuffix(path, ".bin") {
+		series, err = readBinarySeries(reader)
+	} else {
+		series, err = readCSVSeries(reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(series.Times) == 0 {
+		return nil, fmt.Errorf("%v: no points", path)
+	}
+	for i := 1; i < len(series.Times); i++ {
+		if series.Times[i] <= series.Times[i - 1] {
+			return nil, fmt.Errorf("%v: point %v at %v does not come after the one before it at %v", path, i + 1, series.Times[i], series.Times[i - 1])
+		}
+	}
+	return series, nil
+}
+
+func readBinarySeries(reader io.Reader) (*Series, error) {
+	var series *Series = &Series{}
+	var point [16]byte
+	for {
+		_, err := io.ReadFull(reader, point[:])
+		if err == io.EOF {
+			return series, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("point %v: %v", len(series.Times) + 1, err)
+		}
+		series.Times = append(series.Times, int64(binary.LittleEndian.Uint64(point[0:8])))
+		series.Values = append(series.Values, math.Float64frombits(binary.LittleEndian.Uint64(point[8:16])))
+	}
+}
+
+func readCSVSeries(reader *bufio.Reader) (*Series, error) {
+	var series *Series = &Series{}
+	var scanner *bufio.Scanner = bufio.NewScanner(reader)
+	var lineNum int = 0
+	for scanner.Scan() {
+		lineNum++
+		var line string = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var fields []string = strings.Split(line, ",")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: expected time,value, got %q", lineNum, line)
+		}
+		time, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+		if err != nil && len(series.Times) == 0 && lineNum == 1 {
+			continue // a header
+		} else if err != nil {
+			return nil, fmt.Errorf("line %v: could not parse the time: %v", lineNum, err)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: could not parse the value: %v", lineNum, err)
+		}
+		series.Times = append(series.Times, time)
+		series.Values = append(series.Values, value)
+	}
+	return series, scanner.Err()
+}
+
+/* Returns the first n points of the series, shifted to start at firstTime if
+   shift is set, and repeated as often as needed if loop is set; every repeat
+   comes one step (the time between the last two points) after the one
+   before it. */
+func (s *Series) prepare(n int64, shift bool, firstTime int64, loop bool, step int64) (*Series, error) {
+	var length int64 = int64(len(s.Times))
+	if n > length && !loop {
+		return nil, fmt.Errorf("has %v points, but %v are needed (set DATA_LOOP to repeat them)", length, n)
+	}
+	var offset int64 = 0
+	if shift {
+		offset = firstTime - s.Times[0]
+	}
+	if length > 1 {
+		step = s.Times[length - 1] - s.Times[length - 2]
+	}
+	var period int64 = s.Times[length - 1] - s.Times[0] + step
+	var prepared *Series = &Series{Times: make([]int64, n), Values: make([]float64, n)}
+	for i := int64(0); i < n; i++ {
+		prepared.Times[i] = s.Times[i % length] + offset + (i / length) * period
+		prepared.Values[i] = s.Values[i % length]
+	}
+	return prepared, nil
+}
+
+/* The points that a stream inserts when they come from DataFiles or a
+   TIME_PATTERN rather than from the generator, and what the stream holds once
+   they are all inserted. */
+type streamPoints struct {
+	sent *Series // in the order in which they are inserted, POINTS_PER_MESSAGE per message
+	final *Series // sorted by time, and points at the same time by value
+
+	/* Message k of a query asks for [bounds[k], bounds[k + 1]), which holds
+	   final[first[k]:first[k + 1]]. */
+	bounds []int64
+	first []int
+
+	/* Whether points at the same time are in different messages, which then
+	   have to reach the server in the order in which they are sent for the
+	   last one to replace the others. */
+	crossingDuplicates bool
+}
+
+/* Works out what a stream holds after sent is inserted into it, message by
+   message in the order messageOrder (the index of each message, in the order
+   in which they are sent; nil sends them in order), one at a time. With
+   DUPLICATES "replace", the last point inserted at a time replaces those
+   before it. */
+func newStreamPoints(sent *Series, pointsPerMessage int, keepDuplicates bool, messageOrder []int) *streamPoints {
+	var numMessages int = (len(sent.Times) + pointsPerMessage - 1) / pointsPerMessage
+	var rank []int = make([]int, numMessages) // when each message is sent
+	for k := range rank {
+		rank[k] = k
+	}
+	for position, k := range messageOrder {
+		rank[k] = position
+	}
+	var sentAt = func (i int) int {
+		return rank[i / pointsPerMessage] * pointsPerMessage + i % pointsPerMessage
+	}
+	var order []int = make([]int, len(sent.Times))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func (a int, b int) bool {
+		var ta, tb int64 = sent.Times[order[a]], sent.Times[order[b]]
+		return ta < tb || ta == tb && sentAt(order[a]) < sentAt(order[b])
+	})
+	var final *Series = &Series{}
+	var crossing bool = false
+	for n, i := range order {
+		if n + 1 < len(order) && sent.Times[order[n + 1]] == sent.Times[i] {
+			crossing = crossing || order[n + 1] / pointsPerMessage != i / pointsPerMessage
+			if !keepDuplicates {
+				continue // a later point replaces this one
+			}
+		}
+		final.Times = append(final.Times, sent.Times[i])
+		final.Values = append(final.Values, sent.Values[i])
+	}
+	sort.Sort(byTimeAndValue{final})
+
+	/* Queries ask for as many messages as inserts send, each with about as
+	   many points; points at the same time all go to the same message. */
+	var points *streamPoints = &streamPoints{sent: sent, final: final, bounds: make([]int64, numMessages + 1), first: make([]int, numMessages + 1), crossingDuplicates: crossing}
+	for k := 0; k < numMessages; k++ {
+		points.bounds[k] = final.Times[k * len(final.Times) / numMessages]
+	}
+	points.bounds[numMessages] = final.Times[len(final.Times) - 1] + 1
+	for k := range points.bounds {
+		points.first[k] = sort.Search(len(final.Times), func (i int) bool {
+			return final.Times[i] >= points.bounds[k]
+		})
+	}
+	return points
+}
+
+type byTimeAndValue struct {
+	*Series
+}
+
+func (s byTimeAndValue) Len() int {
+	return len(s.Times)
+}
+
+func (s byTimeAndValue) Less(i int, j int) bool {
+	return s.Times[i] < s.Times[j] || s.Times[i] == s.Times[j] && s.Values[i] < s.Values[j]
+}
+
+func (s byTimeAndValue) Swap(i int, j int) {
+	s.Times[i], s.Times[j] = s.Times[j], s.Times[i]
+	s.Values[i], s.Values[j] = s.Values[j], s.Values[i]
+}
+
+/* The number of points that the streams insert: every message is full, so
+   the last one may need more than TOTAL_RECORDS. */
+func (r *Runner) numPoints() int64 {
+	var ppm int64 = int64(r.POINTS_PER_MESSAGE)
+	return (r.TOTAL_RECORDS + ppm - 1) / ppm * ppm
+}
+
+/* Reads DataFiles and gives every stream the points of one of them; there may
+   be fewer files than streams, which then take turns. */
+func (r *Runner) loadData() error {
+	var prepared map[string]*Series = make(map[string]*Series)
+	var points map[string]*streamPoints = make(map[string]*streamPoints)
+	var orders [][]int = r.insertOrders()
+	r.data = make([]*streamPoints, r.NUM_STREAMS)
+	for i := range r.data {
+		var path string = r.DataFiles[i % len(r.DataFiles)]
+		if prepared[path] == nil {
+			series, err := ReadSeries(path)
+			if err != nil {
+				return err
+			}
+			prepared[path], err = series.prepare(r.numPoints(), r.DATA_TIME_SHIFT, r.FIRST_TIME, r.DATA_LOOP, r.NANOS_BETWEEN_POINTS)
+			if err != nil {
+				return fmt.Errorf("%v %v", path, err)
+			}
+		}
+		/* Streams that send the same points in the same order share them. */
+		if orders[i] != nil {
+			r.data[i] = newStreamPoints(prepared[path], int(r.POINTS_PER_MESSAGE), r.duplicatePolicy() == "keep", orders[i])
+			continue
+		}
+		if points[path] == nil {
+			points[path] = newStreamPoints(prepared[path], int(r.POINTS_PER_MESSAGE), r.duplicatePolicy() == "keep", nil)
+		}
+		r.data[i] = points[path]
+	}
+	return nil
+}
+
+/* Whether a workload inserts points at the same time in different messages. */
+func (r *Runner) insertsCrossingDuplicates() bool {
+	for _, w := range r.workloads {
+		if _, ok := w.(dataInsertWorkload); !ok {
+			continue
+		}
+		for _, points := range r.data {
+			if points.crossingDuplicates {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* The order in which the inserting worker of each stream sends its messages,
+   as the indexes of the messages: the order that Run gives it from PERM_SEED,
+   where the inserting workers come first. Only replaced duplicates depend on
+   it, so it is nil for every stream otherwise. */
+func (r *Runner) insertOrders() [][]int {
+	var orders [][]int = make([][]int, r.NUM_STREAMS)
+	if r.duplicatePolicy() == "keep" || r.PERM_SEED == 0 {
+		return orders
+	}
+	var permGen *rand.Rand = rand.New(rand.NewSource(r.PERM_SEED))
+	for i := range orders {
+		var starts []int64 = r.messageStarts(permGen, r.numPoints() / int64(r.POINTS_PER_MESSAGE))
+		orders[i] = make([]int, len(starts))
+		for j, start := range starts {
+			orders[i][j] = r.messageIndex(start)
+		}
+	}
+	return orders
+}
+
+/* Returns the index of the message that would start at start with generated
+   points, so that the order that PERM_SEED gives applies to these points too. */
+func (r *Runner) messageIndex(start int64) int {
+	return int((start - r.FIRST_TIME) / (r.NANOS_BETWEEN_POINTS * int64(r.POINTS_PER_MESSAGE)))
+}
+
+/* Inserts the points of the data files or the time pattern. */
+type dataInsertWorkload struct {
+	r *Runner
+}
+
+func (w dataInsertWorkload) Name() string {
+	return "insert"
+}
+
+func (w dataInsertWorkload) NewWorker(stream Stream) WorkloadWorker {
+	var mp InsertMessagePart = w.r.insertPool.Get().(InsertMessagePart)
+	mp.insert.SetUuid(stream.UUID)
+	return &dataInsertWorker{r: w.r, points: w.r.data[stream.Worker % w.r.NUM_STREAMS], stream: stream, mp: mp}
+}
+
+type dataInsertWorker struct {
+	r *Runner
+	points *streamPoints
+	stream Stream
+	mp InsertMessagePart
+}
+
+func (w *dataInsertWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	var ppm int = int(w.r.POINTS_PER_MESSAGE)
+	var first int = w.r.messageIndex(w.stream.Starts[j]) * ppm
+	w.mp.request.SetEchoTag(echoTag)
+	for i, record := range w.mp.records {
+		record.SetTime(w.points.sent.Times[first + i])
+		record.SetValue(w.points.sent.Values[first + i])
+	}
+	return w.mp.segment, uint64(ppm)
+}
+
+func (w *dataInsertWorker) Verify(resp cpint.Response) (uint64, bool) {
+	return 0, true
+}
+
+func (w *dataInsertWorker) Close() {
+	w.r.insertPool.Put(w.mp)
+}
+
+/* Queries what the streams hold once the points of the data files or the
+   time pattern are inserted, and checks it. */
+type dataQueryWorkload struct {
+	r *Runner
+}
+
+func (w dataQueryWorkload) Name() string {
+	return "query"
+}
+
+func (w dataQueryWorkload) NewWorker(stream Stream) WorkloadWorker {
+	var mp QueryMessagePart = w.r.standQueryPool.Get().(QueryMessagePart)
+	mp.query.SetUuid(stream.UUID)
+	return &dataQueryWorker{r: w.r, points: w.r.data[stream.Worker % w.r.NUM_STREAMS], stream: stream, mp: mp}
+}
+
+type dataQueryWorker struct {
+	r *Runner
+	points *streamPoints
+	stream Stream
+	mp QueryMessagePart
+
+	received Series // the points in the responses to the current message so far, used by Verify
+}
+
+/* Returns the first message that query j asks for and the one after its
+   last. */
+func (w *dataQueryWorker) messages(j uint64) (int, int) {
+	var k int = w.r.messageIndex(w.stream.Starts[j])
+	return k, k + int(w.r.messageSpan(w.stream, j) / (w.r.NANOS_BETWEEN_POINTS * int64(w.r.POINTS_PER_MESSAGE)))
+}
+
+func (w *dataQueryWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	k, end := w.messages(j)
+	w.mp.request.SetEchoTag(echoTag)
+	w.mp.query.SetStartTime(w.points.bounds[k])
+	w.mp.query.SetEndTime(w.points.bounds[end])
+	return w.mp.segment, uint64(w.points.first[end] - w.points.first[k])
+}
+
+/* The echo tag tells which message a response is to, so this works whatever
+   order the messages are sent in. Points at the same time may come in any
+   order, so the points of a message are sorted before they are checked. */
+func (w *dataQueryWorker) Verify(resp cpint.Response) (uint64, bool) {
+	var r *Runner = w.r
+	records := resp.Records().Values()
+	for m := 0; m < records.Len(); m++ {
+		w.received.Times = append(w.received.Times, records.At(m).Time())
+		w.received.Values = append(w.received.Values, records.At(m).Value())
+	}
+	if !resp.Final() {
+		return 0, true
+	}
+
+	var pass bool = true
+	var verified uint64 = 0
+	_, j := r.splitEchoTag(resp.EchoTag())
+	k, end := w.messages(j)
+	var times []int64 = w.points.final.Times[w.points.first[k]:w.points.first[end]]
+	var values []float64 = w.points.final.Values[w.points.first[k]:w.points.first[end]]
+	sort.Sort(byTimeAndValue{&w.received})
+	for i := range w.received.Times {
+		var recTime int64 = w.received.Times[i]
+		var received float64 = w.received.Values[i]
+		if i < len(times) && recTime == times[i] && received == values[i] {
+			verified++
+			if r.PRINT_ALL {
+				fmt.Printf("Received expected point (%v, %v)\n", recTime, received)
+			}
+		} else if i < len(times) {
+			fmt.Printf("Expected (%v, %v), got (%v, %v)\n", times[i], values[i], recTime, received)
+			pass = false
+		} else {
+			fmt.Printf("Got (%v, %v) after the last expected point\n", recTime, received)
+			pass = false
+		}
+	}
+	if len(w.received.Times) != len(times) {
+		fmt.Printf("Expected %v points in query response, but got %v points instead.\n", len(times), len(w.received.Times))
+		pass = false
+	}
+	w.received.Times = w.received.Times[:0]
+	w.received.Values = w.received.Values[:0]
+	return verified, pass
+}
+
+func (w *dataQueryWorker) Close() {
+	w.r.standQueryPool.Put(w.mp)
+}
@@ -0,0 +1,204 @@
+package loadgen
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* When the throughput stops growing, either BTrDB or the generator is
+   saturated. To tell which, the runner times what its own goroutines do:
+
+     workers         pace (POINTS_PER_SECOND), wait for a slot in cont
+                     because MAX_CONCURRENT_MESSAGES messages await their
+                     responses, encode the next message and send it
+     receive loops   one per connection; read a response from the socket,
+                     then decode and check it
+
+   A worker that waits for responses most of the time is held back by the
+   server. One that hardly ever waits, and is not paced, is sending as fast as
+   the generator can, and so is a receive loop that is busy decoding nearly
+   all of the time. */
+type HealthStats struct {
+	Workers int
+	Connections int // that have a receive loop
+	SendMode string // what LockWait waited for
+
+	WorkerTime time.Duration // how long the workers ran, summed
+	PaceWait time.Duration // workers waiting for their time to send, summed
+	ResponseWait time.Duration // workers blocked on cont, summed
+	Encode time.Duration // building capnp messages (and, with SEND_MODE=batch, serializing them)
+	LockWait time.Duration // waiting for the send lock (mutex) or for room in the queue (batch)
+	LockHeld time.Duration // holding the send lock while writing (mutex only)
+	Decode time.Duration // the receive loops decoding and checking responses, summed
+
+	/* These are of the whole process. If other runs went on at the same
+	   time, e.g. the groups of a run or parallel phases of a scenario, they
+	   include theirs, and are not blamed on this run. */
+	GCPause time.Duration
+	NumGC uint32
+	MaxGoroutines int
+	Overlapped bool // other runs went on at the same time
+
+	Warnings []string // why the generator rather than the server may have been the limit
+}
+
+/* How much of the time of the workers or the receive loops makes the
+   generator look saturated. */
+const HEALTH_BUSY_FRACTION = 0.8
+const HEALTH_LOCK_FRACTION = 0.25
+const HEALTH_GC_FRACTION = 0.05
+
+/* The time counters of a run, in ns. They are updated atomically, and sit at
+   the start of the Runner to be 64-bit aligned. */
+type healthCounters struct {
+	workerTime uint64
+	paceWait uint64
+	responseWait uint64
+	encode uint64
+	decode uint64
+	maxGoroutines uint64
+}
+
+/* The runs that are going on in the process, and how many were ever
+   started, to tell whether a run had the process to itself. */
+var runsLock sync.Mutex
+var runsGoingOn int
+var runsStarted uint64
+
+/* Called when a run starts; the function that it returns is called when
+   the run ends, and returns whether another run went on at some time in
+   between. */
+func trackOverlap() func () bool {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+	runsGoingOn++
+	runsStarted++
+	var alone bool = (runsGoingOn == 1)
+	var started uint64 = runsStarted
+	return func () bool {
+		runsLock.Lock()
+		defer runsLock.Unlock()
+		runsGoingOn--
+		return !alone || runsStarted != started
+	}
+}
+
+func since(start time.Time) uint64 {
+	return uint64(time.Since(start))
+}
+
+/* Keeps the highest number of goroutines seen; called from the progress loop. */
+func (h *healthCounters) sampleGoroutines() {
+	var n uint64 = uint64(runtime.NumGoroutine())
+	for {
+		var max uint64 = atomic.LoadUint64(&h.maxGoroutines)
+		if n <= max || atomic.CompareAndSwapUint64(&h.maxGoroutines, max, n) {
+			return
+		}
+	}
+}
+
+/* Puts together the health of a run that took duration, with the GC
+   statistics from before and after it; overlapped tells whether other runs
+   went on at the same time. */
+func (r *Runner) healthStats(workers int, connections int, senders [][]requestSender, before *runtime.MemStats, after *runtime.MemStats, overlapped bool, duration time.Duration) HealthStats {
+	r.health.sampleGoroutines()
+	var h HealthStats = HealthStats{
+		Workers: workers,
+		Connections: connections,
+		SendMode: r.SEND_MODE,
+		WorkerTime: time.Duration(atomic.LoadUint64(&r.health.workerTime)),
+		PaceWait: time.Duration(atomic.LoadUint64(&r.health.paceWait)),
+		ResponseWait: time.Duration(atomic.LoadUint64(&r.health.responseWait)),
+		Encode: time.Duration(atomic.LoadUint64(&r.health.encode)),
+		Decode: time.Duration(atomic.LoadUint64(&r.health.decode)),
+		GCPause: time.Duration(after.PauseTotalNs - before.PauseTotalNs),
+		NumGC: after.NumGC - before.NumGC,
+		MaxGoroutines: int(atomic.LoadUint64(&r.health.maxGoroutines)),
+		Overlapped: overlapped,
+	}
+	for s := range senders {
+		for _, sender := range senders[s] {
+			if sender != nil {
+				var stats senderStats = sender.stats()
+				h.Encode += time.Duration(stats.encode)
+				h.LockWait += time.Duration(stats.lockWait)
+				h.LockHeld += time.Duration(stats.lockHeld)
+			}
+		}
+	}
+	h.Warnings = h.diagnose(duration)
+	return h
+}
+
+/* Returns why the generator may have limited a run that took duration. */
+func (h HealthStats) diagnose(duration time.Duration) []string {
+	var warnings []string
+	if duration <= 0 {
+		return nil
+	}
+	if h.Connections != 0 {
+		var decoding float64 = float64(h.Decode) / float64(duration) / float64(h.Connections)
+		if decoding > HEALTH_BUSY_FRACTION {
+			warnings = append(warnings, fmt.Sprintf("the receive loops were decoding responses %.0f%% of the time, so responses waited for the generator rather than for the server; use more TCP_CONNECTIONS", 100 * decoding))
+		}
+	}
+	if h.WorkerTime > 0 {
+		var workerTime float64 = float64(h.WorkerTime)
+		var busy float64 = 1 - (float64(h.PaceWait) + float64(h.ResponseWait)) / workerTime
+		if busy > HEALTH_BUSY_FRACTION {
+			warnings = append(warnings, fmt.Sprintf("the workers were busy encoding and sending %.0f%% of the time and hardly waited for responses, so the server kept up with the generator", 100 * busy))
+		}
+		var locked float64 = float64(h.LockWait) / workerTime
+		if locked > HEALTH_LOCK_FRACTION {
+			var fix string = "use more TCP_CONNECTIONS"
+			if h.SendMode == "mutex" {
+				fix += " or SEND_MODE=batch"
+			}
+			warnings = append(warnings, fmt.Sprintf("the workers were %v %.0f%% of the time; the connections they share are the limit, so %v", h.sendWait(), 100 * locked, fix))
+		}
+	}
+	var gc float64 = float64(h.GCPause) / float64(duration)
+	if gc > HEALTH_GC_FRACTION && !h.Overlapped {
+		warnings = append(warnings, fmt.Sprintf("garbage collection paused the generator %.1f%% of the time", 100 * gc))
+	}
+	return warnings
+}
+
+/* What the workers wait for before they can send, in SEND_MODE. */
+func (h HealthStats) sendWait() string {
+	if h.SendMode == "mutex" {
+		return "waiting for the send lock"
+	}
+	return "waiting for room in the queue"
+}
+
+func (r *Runner) printHealthReport(h HealthStats, duration time.Duration) {
+	var workerTime float64 = float64(h.WorkerTime)
+	var percent = func (d time.Duration, of float64) float64 {
+		if of <= 0 {
+			return 0
+		}
+		return 100 * float64(d) / of
+	}
+	r.printf("Generator health (%v workers, %v receive loops):\n", h.Workers, h.Connections)
+	r.printf("  %-32s %14v %6.1f%% of the time of the workers\n", "waiting for their time to send", h.PaceWait, percent(h.PaceWait, workerTime))
+	r.printf("  %-32s %14v %6.1f%%\n", "waiting for responses (cont)", h.ResponseWait, percent(h.ResponseWait, workerTime))
+	r.printf("  %-32s %14v %6.1f%%\n", "encoding messages", h.Encode, percent(h.Encode, workerTime))
+	r.printf("  %-32s %14v %6.1f%%\n", h.sendWait(), h.LockWait, percent(h.LockWait, workerTime))
+	if h.SendMode == "mutex" {
+		r.printf("  %-32s %14v %6.1f%%\n", "holding the send lock", h.LockHeld, percent(h.LockHeld, workerTime))
+	}
+	r.printf("  %-32s %14v %6.1f%% of the time of the receive loops\n", "decoding responses", h.Decode, percent(h.Decode, float64(duration) * float64(h.Connections)))
+	r.printf("  %-32s %14v %6.1f%% of the run, in %v collections\n", "GC pauses (whole process)", h.GCPause, percent(h.GCPause, float64(duration)), h.NumGC)
+	r.printf("  %-32s %14v\n", "most goroutines (whole process)", h.MaxGoroutines)
+	if h.Overlapped {
+		r.printf("  (other runs went on at the same time; their GC pauses and goroutines are counted too)\n")
+	}
+	for _, warning := range h.Warnings {
+		r.printf("WARNING: the generator may have been the limit: %v\n", warning)
+	}
+}
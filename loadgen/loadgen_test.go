@@ -0,0 +1,1156 @@
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+	"github.com/lilvinz/quasarloadgenerator/fakedb"
+	"github.com/pborman/uuid"
+)
+
+func startTestServer(t testing.TB) *fakedb.Server {
+	srv, err := fakedb.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func testConfig(t testing.TB, command string, addr string, numStreams int) Config {
+	var cfg Config = DefaultConfig()
+	cfg.Name = command
+	cfg.Command = command
+	cfg.StatsFile = filepath.Join(t.TempDir(), "stats.json")
+	cfg.DB_ADDRS = []string{addr}
+	for j := 0; j < numStreams; j++ {
+		cfg.UUIDS = append(cfg.UUIDS, uuid.NewSHA1(uuid.NameSpace_OID, []byte(fmt.Sprintf("%v%v", t.Name(), j))))
+	}
+	cfg.POINTS_PER_MESSAGE = 256
+	cfg.DETERMINISTIC_KV = true
+	return cfg
+}
+
+func run(t testing.TB, ctx context.Context, cfg Config) Result {
+	r, err := NewRunner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.Run(ctx)
+}
+
+/* Inserts and then verifies several streams that share connections. Run it
+   with go test -race to check the workers for data races. */
+func TestInsertVerify(t *testing.T) {
+	for _, mode := range SendModes {
+		t.Run(mode, func (t *testing.T) {
+			var srv *fakedb.Server = startTestServer(t)
+			defer srv.Close()
+			for _, command := range []string{"insert", "verify"} {
+				var cfg Config = testConfig(t, command, srv.Addr(), 6)
+				cfg.TOTAL_RECORDS = 4096
+				cfg.TCP_CONNECTIONS = 2
+				cfg.MAX_CONCURRENT_MESSAGES = 3
+				cfg.SEND_MODE = mode
+				var result Result = run(t, context.Background(), cfg)
+				if result.Points != 6 * 4096 {
+					t.Errorf("%v moved %v points, expected %v", command, result.Points, 6 * 4096)
+				}
+				if command == "verify" && (!result.Pass || result.Verified != 6 * 4096) {
+					t.Errorf("verified %v points, pass = %v", result.Verified, result.Pass)
+				}
+			}
+		})
+	}
+}
+
+/* Inserts into the fake server in every SEND_MODE, with many streams sharing
+   few connections and small messages, where how the workers write to the
+   connections matters most. */
+func BenchmarkSendModes(b *testing.B) {
+	for _, mode := range SendModes {
+		b.Run(mode, func (b *testing.B) {
+			var srv *fakedb.Server = startTestServer(b)
+			defer srv.Close()
+			var cfg Config = testConfig(b, "insert", srv.Addr(), 16)
+			cfg.TOTAL_RECORDS = 1 << 14
+			cfg.POINTS_PER_MESSAGE = 64
+			cfg.TCP_CONNECTIONS = 2
+			cfg.SEND_MODE = mode
+			var points uint64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var result Result = run(b, context.Background(), cfg)
+				if !result.Pass {
+					b.Fatal(result.Err)
+				}
+				points += result.Points
+			}
+			b.ReportMetric(float64(points) / b.Elapsed().Seconds(), "points/s")
+		})
+	}
+}
+
+/* Verifies standard and statistical queries, also when the server splits
+   its results over several responses or they are sent in a shuffled order. */
+func TestVerifyQueries(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	var cfg Config = testConfig(t, "insert", srv.Addr(), 2)
+	cfg.TOTAL_RECORDS = 4096
+	if result := run(t, context.Background(), cfg); !result.Pass {
+		t.Fatalf("insert failed: %v", result.Err)
+	}
+
+	for _, chunkSize := range []int{0, 100} {
+		srv.ChunkSize = chunkSize
+		for _, pw := range []int{-1, 20, 22, 28} {
+			for _, permSeed := range []int64{0, 3} {
+				cfg.Command = "verify"
+				cfg.STATISTICAL_PW = pw
+				cfg.PERM_SEED = permSeed
+				var result Result = run(t, context.Background(), cfg)
+				if !result.Pass || result.Verified != 2 * 4096 {
+					t.Errorf("chunk size %v, pw %v, PERM_SEED %v: verified %v points, pass = %v", chunkSize, pw, permSeed, result.Verified, result.Pass)
+				}
+			}
+		}
+	}
+}
+
+/* Cancelling a run must stop it even if the server never answers. */
+func TestCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func () {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn) // read everything and never answer
+		}
+	}()
+
+	for _, command := range []string{"insert", "verify", "delete"} {
+		var cfg Config = testConfig(t, command, listener.Addr().String(), 4)
+		ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+		r, err := NewRunner(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var finished chan Result = make(chan Result)
+		go func () {
+			finished <- r.Run(ctx)
+		}()
+		select {
+		case result := <-finished:
+			if !result.Cancelled || result.Pass && command == "verify" {
+				t.Errorf("%v: cancelled = %v, pass = %v", command, result.Cancelled, result.Pass)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%v did not stop after it was cancelled", command)
+		}
+		cancel()
+	}
+}
+
+/* A workload of our own: queries every message of a stream and only checks
+   how many points come back. */
+type countWorkload struct {
+	cfg Config
+}
+
+func (w countWorkload) Name() string {
+	return "count"
+}
+
+func (w countWorkload) NewWorker(stream Stream) WorkloadWorker {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var req cpint.Request = cpint.NewRootRequest(seg)
+	var query cpint.CmdQueryStandardValues = cpint.NewCmdQueryStandardValues(seg)
+	query.SetUuid(stream.UUID)
+	req.SetQueryStandardValues(query)
+	return &countWorker{cfg: w.cfg, stream: stream, segment: seg, request: req, query: query}
+}
+
+type countWorker struct {
+	cfg Config
+	stream Stream
+	segment *capnp.Segment
+	request cpint.Request
+	query cpint.CmdQueryStandardValues
+}
+
+func (w *countWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	w.request.SetEchoTag(echoTag)
+	w.query.SetStartTime(w.stream.Starts[j])
+	w.query.SetEndTime(w.stream.Starts[j] + w.cfg.NANOS_BETWEEN_POINTS * int64(w.cfg.POINTS_PER_MESSAGE))
+	return w.segment, uint64(w.cfg.POINTS_PER_MESSAGE)
+}
+
+func (w *countWorker) Verify(resp cpint.Response) (uint64, bool) {
+	var n uint64 = uint64(resp.Records().Values().Len())
+	return n, n == uint64(w.cfg.POINTS_PER_MESSAGE)
+}
+
+func (w *countWorker) Close() {
+}
+
+func TestCustomWorkload(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+
+	var cfg Config = testConfig(t, "insert", srv.Addr(), 3)
+	cfg.TOTAL_RECORDS = 2048
+	if result := run(t, context.Background(), cfg); !result.Pass {
+		t.Fatalf("insert failed: %v", result.Err)
+	}
+
+	cfg.Command = "count"
+	cfg.VERIFY_RESPONSES = true
+	cfg.Workloads = []Workload{countWorkload{cfg}}
+	var result Result = run(t, context.Background(), cfg)
+	if !result.Pass || result.Verified != 3 * 2048 {
+		t.Errorf("verified %v points, pass = %v, err = %v", result.Verified, result.Pass, result.Err)
+	}
+
+	cfg.TOTAL_RECORDS = 4096 // the second half of every query is empty
+	cfg.Workloads = []Workload{countWorkload{cfg}}
+	if result = run(t, context.Background(), cfg); result.Pass {
+		t.Errorf("count passed with missing points")
+	}
+}
+
+/* Every fault of the fake server must either be coped with or make the run
+   fail with the right error, and never make it hang. */
+func TestFaults(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	var cfg Config = testConfig(t, "insert", srv.Addr(), 4)
+	cfg.TOTAL_RECORDS = 4096
+	if result := run(t, context.Background(), cfg); !result.Pass {
+		t.Fatalf("insert failed: %v", result.Err)
+	}
+
+	for _, test := range []struct {
+		name string
+		faults fakedb.Faults
+		chunkSize int
+		pw int
+		err string // part of the error that stops the run; "" if it must not stop
+		pass bool
+	}{
+		{"delay", fakedb.Faults{Delay: 2 * time.Millisecond}, 0, -1, "", true},
+		{"split", fakedb.Faults{}, 100, -1, "", true},
+		{"split statistical", fakedb.Faults{}, 7, 22, "", true},
+		{"reorder", fakedb.Faults{Reorder: true}, 0, -1, "", true},
+		{"drop", fakedb.Faults{DropAfter: 10}, 0, -1, "could not ", false}, // send or receive, whichever notices first
+		{"echo tag", fakedb.Faults{WrongEchoTagEvery: 5}, 0, -1, "unknown echo tag", false},
+		{"status", fakedb.Faults{ErrorEvery: 5}, 0, -1, "status code internalError", false},
+		{"corrupt", fakedb.Faults{CorruptEvery: 3}, 0, -1, "", false},
+		{"corrupt statistical", fakedb.Faults{CorruptEvery: 3}, 0, 22, "", false},
+		{"split and drop", fakedb.Faults{DropAfter: 30}, 100, -1, "could not ", false},
+	} {
+		srv.SetFaults(test.faults)
+		srv.SetChunkSize(test.chunkSize) // the previous run may have left requests behind
+		cfg.Name = test.name
+		cfg.Command = "verify"
+		cfg.STATISTICAL_PW = test.pw
+		r, err := NewRunner(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var finished chan Result = make(chan Result)
+		go func () {
+			finished <- r.Run(context.Background())
+		}()
+		var result Result
+		select {
+		case result = <-finished:
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%v: the run did not finish", test.name)
+		}
+		if result.Pass != test.pass {
+			t.Errorf("%v: pass = %v, want %v", test.name, result.Pass, test.pass)
+		}
+		if test.err == "" && result.Err != nil || test.err != "" && (result.Err == nil || !strings.Contains(result.Err.Error(), test.err)) {
+			t.Errorf("%v: error %v, want one with %q", test.name, result.Err, test.err)
+		}
+		if test.pass && result.Verified != 4 * 4096 {
+			t.Errorf("%v: verified %v points, want %v", test.name, result.Verified, 4 * 4096)
+		}
+	}
+}
+
+/* The echo tags of the requests in a recording, in the order in which they
+   were recorded. */
+func recordedEchoTags(t *testing.T, path string) []uint64 {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var reader *bufio.Reader = bufio.NewReader(file)
+	if _, err := readRecordingServers(reader); err != nil {
+		t.Fatal(err)
+	}
+	var tags []uint64
+	for {
+		var header recordHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err == io.EOF {
+			return tags
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		seg, err := capnp.ReadFromStream(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, cpint.ReadRootRequest(seg).EchoTag())
+	}
+}
+
+/* The requests of a connection must be recorded in the order in which they
+   go out on it, even when several workers share it. */
+func TestRecordOrder(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var lock sync.Mutex
+	var received []uint64 // the echo tags, in the order in which they arrive
+	go func () {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func () {
+				defer conn.Close()
+				for {
+					seg, err := capnp.ReadFromStream(conn, nil)
+					if err != nil {
+						return
+					}
+					var req cpint.Request = cpint.ReadRootRequest(seg)
+					lock.Lock()
+					received = append(received, req.EchoTag())
+					lock.Unlock()
+					for _, out := range srv.Handle(req) {
+						out.WriteTo(conn)
+					}
+				}
+			}()
+		}
+	}()
+
+	for _, mode := range SendModes {
+		lock.Lock()
+		received = nil
+		lock.Unlock()
+		var cfg Config = testConfig(t, "insert", listener.Addr().String(), 16)
+		cfg.TOTAL_RECORDS = 4096
+		cfg.POINTS_PER_MESSAGE = 16
+		cfg.PERM_SEED = 3
+		cfg.SEND_MODE = mode
+		cfg.RecordFile = filepath.Join(t.TempDir(), "insert.rec")
+		if result := run(t, context.Background(), cfg); !result.Pass {
+			t.Fatalf("%v: insert failed: %v", mode, result.Err)
+		}
+		var recorded []uint64 = recordedEchoTags(t, cfg.RecordFile)
+		lock.Lock()
+		if len(recorded) != 16 * 256 || fmt.Sprint(recorded) != fmt.Sprint(received) {
+			t.Errorf("%v: recorded %v requests in another order than the %v that were sent", mode, len(recorded), len(received))
+		}
+		lock.Unlock()
+	}
+}
+
+/* Deletes and flushes are checked like every other request: a bad status or
+   echo tag must fail the run. */
+func TestDeleteFlush(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	var cfg Config = testConfig(t, "insert", srv.Addr(), 4)
+	cfg.TOTAL_RECORDS = 2048
+	cfg.TCP_CONNECTIONS = 2
+	if result := run(t, context.Background(), cfg); !result.Pass {
+		t.Fatalf("insert failed: %v", result.Err)
+	}
+
+	for _, test := range []struct {
+		command string
+		faults fakedb.Faults
+		err string
+	}{
+		{"flush", fakedb.Faults{ErrorEvery: 2}, "status code internalError"},
+		{"delete", fakedb.Faults{WrongEchoTagEvery: 2}, "unknown echo tag"},
+		{"flush", fakedb.Faults{}, ""},
+		{"delete", fakedb.Faults{}, ""},
+	} {
+		srv.SetFaults(test.faults)
+		cfg.Command = test.command
+		var result Result = run(t, context.Background(), cfg)
+		if result.Pass != (test.err == "") || test.err != "" && (result.Err == nil || !strings.Contains(result.Err.Error(), test.err)) {
+			t.Errorf("%v with %+v: pass = %v, error %v, want one with %q", test.command, test.faults, result.Pass, result.Err, test.err)
+		}
+	}
+	if _, points := srv.Size(); points != 0 {
+		t.Errorf("%v points are left after the delete", points)
+	}
+}
+
+/* A recorded insert, replayed against an empty server, must leave it with the
+   same points, which a verify run then finds. */
+func TestRecordReplay(t *testing.T) {
+	var original *fakedb.Server = startTestServer(t)
+	defer original.Close()
+	var cfg Config = testConfig(t, "insert", original.Addr(), 3)
+	cfg.TOTAL_RECORDS = 2048
+	cfg.TCP_CONNECTIONS = 2
+	cfg.RecordFile = filepath.Join(t.TempDir(), "insert.rec")
+	if result := run(t, context.Background(), cfg); !result.Pass {
+		t.Fatalf("insert failed: %v", result.Err)
+	}
+
+	for _, speed := range []float64{0, 1, 4} {
+		var copy *fakedb.Server = startTestServer(t)
+		var result Result = Replay(context.Background(), ReplayConfig{Name: "replay", File: cfg.RecordFile, DB_ADDRS: []string{copy.Addr()}, Speed: speed})
+		if !result.Pass || result.Points != 3 * 2048 {
+			t.Errorf("speed %v: replayed %v points, pass = %v, error %v", speed, result.Points, result.Pass, result.Err)
+		}
+		streams, points := copy.Size()
+		if streams != 3 || points != 3 * 2048 {
+			t.Errorf("speed %v: replay left %v points in %v streams", speed, points, streams)
+		}
+
+		var verify Config = cfg
+		verify.Command = "verify"
+		verify.DB_ADDRS = []string{copy.Addr()}
+		verify.RecordFile = ""
+		if result := run(t, context.Background(), verify); !result.Pass || result.Verified != 3 * 2048 {
+			t.Errorf("speed %v: verified %v points of the replay, pass = %v", speed, result.Verified, result.Pass)
+		}
+		copy.Close()
+	}
+
+	/* Replaying against the wrong number of servers, or something that is
+	   not a recording, fails before anything is sent. */
+	if result := Replay(context.Background(), ReplayConfig{File: cfg.RecordFile, DB_ADDRS: []string{"a:1", "b:2"}}); result.Err == nil {
+		t.Errorf("replayed against two servers what was recorded against one")
+	}
+	if result := Replay(context.Background(), ReplayConfig{File: cfg.StatsFile}); result.Err == nil {
+		t.Errorf("replayed a file that is not a recording")
+	}
+}
+
+/* Cancelling a replay must stop it even if the server stopped reading, so
+   that the queue of the connection is full and the write to it never returns. */
+func TestReplayCancel(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	var cfg Config = testConfig(t, "insert", srv.Addr(), 4)
+	cfg.TOTAL_RECORDS = 1 << 17
+	cfg.POINTS_PER_MESSAGE = 4096
+	cfg.RecordFile = filepath.Join(t.TempDir(), "insert.rec")
+	if result := run(t, context.Background(), cfg); !result.Pass {
+		t.Fatalf("insert failed: %v", result.Err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted chan net.Conn = make(chan net.Conn, 16)
+	go func () {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn // never read from
+		}
+	}()
+	defer func () {
+		listener.Close()
+		for conn := range accepted {
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+	var finished chan Result = make(chan Result)
+	go func () {
+		finished <- Replay(ctx, ReplayConfig{File: cfg.RecordFile, DB_ADDRS: []string{listener.Addr().String()}})
+	}()
+	select {
+	case result := <-finished:
+		if !result.Cancelled || result.Pass || result.Err != nil {
+			t.Errorf("cancelled = %v, pass = %v, error %v", result.Cancelled, result.Pass, result.Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the replay did not stop after it was cancelled")
+	}
+}
+
+/* Writes the points (start + i * i, i / 8) for i in [0, n) in the format that
+   the name of the file asks for. */
+func writeDataFile(t *testing.T, name string, start int64, n int) string {
+	var path string = filepath.Join(t.TempDir(), name)
+	var buf bytes.Buffer
+	if strings.HasSuffix(name, ".bin") {
+		for i := 0; i < n; i++ {
+			binary.Write(&buf, binary.LittleEndian, start + int64(i * i))
+			binary.Write(&buf, binary.LittleEndian, float64(i) / 8)
+		}
+	} else {
+		fmt.Fprintf(&buf, "time,value\n# a comment\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&buf, "%v,%v\n", start + int64(i * i), float64(i) / 8)
+		}
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/* Inserts the points of data files, also shifted and repeated, and verifies
+   them against the same files. */
+func TestDataFiles(t *testing.T) {
+	var csv string = writeDataFile(t, "points.csv", 1000, 4096)
+	var short string = writeDataFile(t, "short.bin", 5000, 1000)
+	for _, test := range []struct {
+		name string
+		files []string
+		shift, loop bool
+		permSeed int64
+	}{
+		{"csv", []string{csv}, false, false, 0},
+		{"shuffled", []string{csv}, false, false, 7},
+		{"looped", []string{short}, true, true, 0},
+		{"both", []string{csv, short}, false, true, 7},
+	} {
+		var srv *fakedb.Server = startTestServer(t)
+		var cfg Config = testConfig(t, "insert", srv.Addr(), 3)
+		cfg.TOTAL_RECORDS = 4096
+		cfg.DataFiles = test.files
+		cfg.DATA_TIME_SHIFT = test.shift
+		cfg.DATA_LOOP = test.loop
+		cfg.PERM_SEED = test.permSeed
+		if result := run(t, context.Background(), cfg); !result.Pass || result.Points != 3 * 4096 {
+			t.Errorf("%v: inserted %v points, error %v", test.name, result.Points, result.Err)
+		}
+		for _, id := range cfg.UUIDS {
+			if n := srv.NumPoints(id); n != 4096 {
+				t.Errorf("%v: %v points in a stream, want 4096", test.name, n)
+			}
+		}
+		cfg.Command = "verify"
+		if result := run(t, context.Background(), cfg); !result.Pass || result.Verified != 3 * 4096 {
+			t.Errorf("%v: verified %v points, pass = %v", test.name, result.Verified, result.Pass)
+		}
+		srv.Close()
+	}
+
+	/* A point that differs from the file must be found. */
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	var cfg Config = testConfig(t, "insert", srv.Addr(), 1)
+	cfg.TOTAL_RECORDS = 4096
+	cfg.DataFiles = []string{csv}
+	run(t, context.Background(), cfg)
+	cfg.Command = "verify"
+	cfg.DataFiles = []string{writeDataFile(t, "points.csv", 1001, 4096)}
+	if result := run(t, context.Background(), cfg); result.Pass {
+		t.Errorf("verified the points of one file against another")
+	}
+}
+
+func TestReadSeries(t *testing.T) {
+	var dir string = t.TempDir()
+	for _, test := range []struct {
+		name string
+		contents string
+		times []int64 // nil if reading must fail
+	}{
+		{"plain.csv", "1,0.5\n2,1.5\n\n4,-3\n", []int64{1, 2, 4}},
+		{"header.csv", "time, value\n10, 1\n# skipped\n20, 2\n", []int64{10, 20}},
+		{"unordered.csv", "1,0\n3,0\n2,0\n", nil},
+		{"duplicate.csv", "1,0\n1,0\n", nil},
+		{"bad.csv", "1,0\nx,0\n", nil},
+		{"fields.csv", "1,0,0\n", nil},
+		{"empty.csv", "# nothing\n", nil},
+		{"truncated.bin", "0123456789abcdef01234567", nil},
+	} {
+		var path string = filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		series, err := ReadSeries(path)
+		if test.times == nil {
+			if err == nil {
+				t.Errorf("%v: read %v", test.name, series.Times)
+			}
+			continue
+		}
+		if err != nil || !equalTimes(series.Times, test.times) {
+			t.Errorf("%v: read %v, error %v; want %v", test.name, series, err, test.times)
+		}
+	}
+}
+
+func TestPrepareSeries(t *testing.T) {
+	var series *Series = &Series{Times: []int64{10, 12, 15}, Values: []float64{1, 2, 3}}
+	for _, test := range []struct {
+		n int64
+		shift, loop bool
+		want []int64
+	}{
+		{2, false, false, []int64{10, 12}},
+		{3, true, false, []int64{100, 102, 105}},
+		{4, false, false, nil},
+		{7, false, true, []int64{10, 12, 15, 18, 20, 23, 26}},
+		{4, true, true, []int64{100, 102, 105, 108}},
+	} {
+		prepared, err := series.prepare(test.n, test.shift, 100, test.loop, 1)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%+v: prepared %v", test, prepared.Times)
+			}
+			continue
+		}
+		if err != nil || !equalTimes(prepared.Times, test.want) {
+			t.Errorf("%+v: prepared %v, error %v", test, prepared, err)
+		}
+	}
+}
+
+func TestParseTimePattern(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want TimePattern
+		ok bool
+	}{
+		{"", TimePattern{}, true},
+		{"none", TimePattern{}, true},
+		{"gaps=100/5000, jitter=0.5", TimePattern{GapEvery: 100, GapLength: 5000, Jitter: 0.5}, true},
+		{"bursts=10/4/1,duplicates=0.1,reorder=0.2/64", TimePattern{BurstEvery: 10, BurstPoints: 4, BurstNanos: 1, Duplicates: 0.1, Reorder: 0.2, ReorderDistance: 64}, true},
+		{"gaps=100", TimePattern{}, false},
+		{"gaps=0/5", TimePattern{}, false},
+		{"bursts=4/4/1", TimePattern{}, false},
+		{"jitter=1", TimePattern{}, false},
+		{"duplicates=-0.1", TimePattern{}, false},
+		{"reorder=0.1", TimePattern{}, false},
+		{"holes=1/2", TimePattern{}, false},
+		{"gaps", TimePattern{}, false},
+	} {
+		p, err := ParseTimePattern(test.value)
+		if test.ok && (err != nil || p != test.want) {
+			t.Errorf("%q: parsed %+v, error %v; want %+v", test.value, p, err, test.want)
+		} else if !test.ok && err == nil {
+			t.Errorf("%q: parsed %+v", test.value, p)
+		}
+	}
+}
+
+func TestGeneratePattern(t *testing.T) {
+	var zero = func (int64, *rand.Rand) float64 {
+		return 0
+	}
+	var p TimePattern = TimePattern{GapEvery: 10, GapLength: 1000, BurstEvery: 7, BurstPoints: 2, BurstNanos: 1}
+	var series *Series = p.generate(21, 100, 10, rand.New(rand.NewSource(1)), zero)
+	var want []int64 = []int64{100, 101, 102, 112, 122, 132, 142, 152, 153, 154, 1164, 1174, 1184, 1194, 1204, 1205, 1206, 1216, 1226, 1236, 2246}
+	if !equalTimes(series.Times, want) {
+		t.Errorf("generated %v, want %v", series.Times, want)
+	}
+
+	/* Duplicates and reordering keep the points, but change their order. */
+	p = TimePattern{Jitter: 0.5, Duplicates: 0.2, Reorder: 0.2, ReorderDistance: 8}
+	series = p.generate(1000, 100, 10, rand.New(rand.NewSource(1)), zero)
+	var sorted []int64 = append([]int64(nil), series.Times...)
+	sort.Slice(sorted, func (i int, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	var duplicates, unordered int
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i - 1] {
+			duplicates++
+		}
+		if series.Times[i] < series.Times[i - 1] {
+			unordered++
+		}
+		if sorted[i] - sorted[i - 1] > 15 {
+			t.Errorf("%v ns between points with a jitter of 0.5", sorted[i] - sorted[i - 1])
+		}
+	}
+	if duplicates < 100 || duplicates > 300 || unordered < 100 {
+		t.Errorf("%v duplicates and %v points out of order in 1000", duplicates, unordered)
+	}
+}
+
+/* Inserts and verifies points with irregular times, both with duplicates kept
+   and replaced, in whatever order PERM_SEED gives. */
+func TestTimePatterns(t *testing.T) {
+	p, err := ParseTimePattern("gaps=100/100000000,bursts=50/20/1,jitter=0.5,duplicates=0.1,reorder=0.1/600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		duplicates string
+		kv bool
+		permSeed int64
+	}{
+		{"keep", true, 0},
+		{"replace", true, 5},
+		{"keep", false, 5},
+		{"replace", false, 0},
+		{"replace", false, 5}, // the last point sent at a time wins, not the last in the series
+	} {
+		var srv *fakedb.Server = startTestServer(t)
+		srv.ReplaceDuplicates = (test.duplicates == "replace")
+		var cfg Config = testConfig(t, "insert", srv.Addr(), 2)
+		cfg.TOTAL_RECORDS = 4000
+		cfg.TIME_PATTERN = p
+		cfg.DUPLICATES = test.duplicates
+		cfg.DETERMINISTIC_KV = test.kv
+		cfg.PERM_SEED = test.permSeed
+		if test.duplicates == "replace" {
+			/* Duplicates in different messages must reach the server in order. */
+			if _, err := NewRunner(cfg); err == nil || err.(ConfigError).Key != "MAX_CONCURRENT_MESSAGES" {
+				t.Errorf("%+v: replacing duplicates with %v messages in flight, error %v", test, cfg.MAX_CONCURRENT_MESSAGES, err)
+			}
+			cfg.MAX_CONCURRENT_MESSAGES = 1
+		}
+		if result := run(t, context.Background(), cfg); !result.Pass || result.Points != 2 * 4096 {
+			t.Errorf("%+v: inserted %v points, error %v", test, result.Points, result.Err)
+		}
+		cfg.Command = "verify"
+		result := run(t, context.Background(), cfg)
+		if !result.Pass || result.Verified == 0 || test.duplicates == "keep" && result.Verified != 2 * 4096 {
+			t.Errorf("%+v: verified %v points, pass = %v", test, result.Verified, result.Pass)
+		}
+
+		/* Expecting the other policy must fail. */
+		if test.duplicates == "keep" {
+			cfg.DUPLICATES = "replace"
+		} else {
+			cfg.DUPLICATES = "keep"
+		}
+		if result := run(t, context.Background(), cfg); result.Pass {
+			t.Errorf("%+v: verified against DUPLICATES %v", test, cfg.DUPLICATES)
+		}
+		srv.Close()
+	}
+}
+
+func TestParseQueryAccess(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want QueryAccess
+		ok bool
+	}{
+		{"none", QueryAccess{}, true},
+		{"zipf=1.1, recent=0.8/0.1", QueryAccess{StreamSkew: 1.1, RecentQueries: 0.8, RecentSpan: 0.1}, true},
+		{"hotspots=3/0.01/0.2,window=1/16", QueryAccess{Hotspots: 3, HotspotWidth: 0.01, HotspotQueries: 0.2, MinWindow: 1, MaxWindow: 16}, true},
+		{"recent=0.5/0", QueryAccess{}, false},
+		{"hotspots=0/0.1/0.5", QueryAccess{}, false},
+		{"window=4/2", QueryAccess{}, false},
+		{"recent=0.8/0.1,hotspots=1/0.1/0.3", QueryAccess{}, false},
+		{"zipf", QueryAccess{}, false},
+		{"latest=1", QueryAccess{}, false},
+	} {
+		a, err := ParseQueryAccess(test.value)
+		if test.ok && (err != nil || a != test.want) {
+			t.Errorf("%q: parsed %+v, error %v; want %+v", test.value, a, err, test.want)
+		} else if !test.ok && err == nil {
+			t.Errorf("%q: parsed %+v", test.value, a)
+		}
+	}
+}
+
+/* Checks that the queries follow the distributions and can be repeated. */
+func TestQueryAccessDistributions(t *testing.T) {
+	var cfg Config = DefaultConfig()
+	cfg.Command = "query"
+	cfg.POINTS_PER_MESSAGE = 1
+	cfg.NANOS_BETWEEN_POINTS = 10
+	cfg.FIRST_TIME = 1000
+	var r *Runner = newTestRunner(t, cfg)
+	r.NUM_STREAMS = 4
+	r.QUERY_ACCESS = QueryAccess{StreamSkew: 2, RecentQueries: 0.5, RecentSpan: 0.1, Hotspots: 1, HotspotWidth: 0.05, HotspotQueries: 0.3, MinWindow: 1, MaxWindow: 4}
+	var generate = func () ([][]int64, [][]int64) {
+		var starts [][]int64 = make([][]int64, 4)
+		var spans [][]int64 = make([][]int64, 4)
+		r.queryAccess(rand.New(rand.NewSource(9)), 1000, starts, spans)
+		return starts, spans
+	}
+	starts, spans := generate()
+	again, _ := generate()
+
+	var counts []int
+	var recent, total int
+	for z := range starts {
+		counts = append(counts, len(starts[z]))
+		total += len(starts[z])
+		if !equalTimes(starts[z], again[z]) {
+			t.Errorf("stream %v: the queries differ with the same seed", z)
+		}
+		for q, start := range starts[z] {
+			if spans[z][q] < 10 || spans[z][q] > 40 || start < 1000 || start + spans[z][q] > 1000 + 10 * 1000 || (start - 1000) % 10 != 0 {
+				t.Errorf("query [%v, %v) is not whole messages within the stream", start, start + spans[z][q])
+			}
+			if start >= 1000 + 10 * 900 {
+				recent++
+			}
+		}
+	}
+	sort.Ints(counts)
+	if total != 4000 || counts[3] < 2 * counts[2] || counts[0] == 0 {
+		t.Errorf("%v queries per stream, want 4000 in total with a skew of 2", counts)
+	}
+	if recent < total / 2 || recent > total * 7 / 10 {
+		t.Errorf("%v of %v queries are in the last 10%% of the time", recent, total)
+	}
+}
+
+/* Verifies queries with a skewed access pattern, for each kind of query. */
+func TestQueryAccess(t *testing.T) {
+	access, err := ParseQueryAccess("zipf=1.5,recent=0.5/0.2,hotspots=2/0.1/0.3,window=1/5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		pw int
+		pattern string
+	}{
+		{"standard", -1, ""},
+		{"statistical", 26, ""},
+		{"pattern", -1, "duplicates=0.1,reorder=0.1/100"},
+	} {
+		var srv *fakedb.Server = startTestServer(t)
+		srv.ChunkSize = 100
+		var cfg Config = testConfig(t, "insert", srv.Addr(), 3)
+		cfg.TOTAL_RECORDS = 4096
+		cfg.TIME_PATTERN, _ = ParseTimePattern(test.pattern)
+		if result := run(t, context.Background(), cfg); !result.Pass {
+			t.Fatalf("%v: insert failed: %v", test.name, result.Err)
+		}
+		cfg.Command = "verify"
+		cfg.STATISTICAL_PW = test.pw
+		cfg.QUERY_ACCESS = access
+		cfg.PERM_SEED = 4
+		/* The points of a time pattern are not spread evenly over the
+		   messages, so only generated ones can be counted exactly. */
+		result := run(t, context.Background(), cfg)
+		if !result.Pass || result.Points <= 3 * 4096 || test.pattern == "" && result.Verified != result.Points {
+			t.Errorf("%v: verified %v of %v points, pass = %v", test.name, result.Verified, result.Points, result.Pass)
+		}
+		srv.Close()
+	}
+}
+
+func TestParseQueryRanges(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want QueryRanges
+		ok bool
+	}{
+		{"none", QueryRanges{}, true},
+		{"span=1s/1y, pw=20/40", QueryRanges{MinSpan: 1000000000, MaxSpan: 365 * 24 * 3600 * 1000000000, MinPW: 20, MaxPW: 40}, true},
+		{"span=1500/2.5ms", QueryRanges{MinSpan: 1500, MaxSpan: 2500000}, true},
+		{"span=1m/1ms", QueryRanges{}, false},
+		{"span=1w/2w", QueryRanges{}, false},
+		{"span=0/1s", QueryRanges{}, false},
+		{"pw=30/20", QueryRanges{}, false},
+		{"pw=0/20", QueryRanges{}, false},
+		{"pw=20/63", QueryRanges{}, false},
+		{"zoom=1/2", QueryRanges{}, false},
+	} {
+		q, err := ParseQueryRanges(test.value)
+		if test.ok && (err != nil || q != test.want) {
+			t.Errorf("%q: parsed %+v, error %v; want %+v", test.value, q, err, test.want)
+		} else if !test.ok && err == nil {
+			t.Errorf("%q: parsed %+v", test.value, q)
+		}
+	}
+
+	/* Spans are spread over the orders of magnitude. */
+	spans, pws := QueryRanges{MinSpan: 10, MaxSpan: 100000, MinPW: 3, MaxPW: 5}.draw(4000, rand.New(rand.NewSource(1)))
+	var magnitudes [5]int
+	for i, span := range spans {
+		if span < 10 || span > 100000 || pws[i] < 3 || pws[i] > 5 {
+			t.Fatalf("drew span %v and pw %v", span, pws[i])
+		}
+		magnitudes[int(math.Log10(float64(span))) - 1]++
+	}
+	for m, n := range magnitudes[:4] {
+		if n < 800 || n > 1200 {
+			t.Errorf("%v of 4000 spans between 10^%v and 10^%v", n, m + 1, m + 2)
+		}
+	}
+}
+
+/* Queries with random spans and point widths, and reports every point width. */
+func TestQueryRanges(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	var cfg Config = testConfig(t, "insert", srv.Addr(), 2)
+	cfg.TOTAL_RECORDS = 4096
+	if result := run(t, context.Background(), cfg); !result.Pass {
+		t.Fatalf("insert failed: %v", result.Err)
+	}
+	cfg.Command = "query"
+	cfg.QUERY_RANGES, _ = ParseQueryRanges("span=1ms/10s,pw=20/24")
+	var result Result = run(t, context.Background(), cfg)
+	if !result.Pass || result.Points == 0 {
+		t.Fatalf("query failed: %v", result.Err)
+	}
+	var queries uint64
+	for _, s := range result.PointWidths {
+		if s.PW < 20 || s.PW > 24 || s.Records == 0 || s.Latency <= 0 {
+			t.Errorf("%+v for a point width", s)
+		}
+		queries += s.Queries
+	}
+	if len(result.PointWidths) != 5 || queries != 2 * 16 {
+		t.Errorf("%v queries over %v point widths, want 32 over 5", queries, len(result.PointWidths))
+	}
+
+	cfg.Command = "verify"
+	if _, err := NewRunner(cfg); err == nil {
+		t.Errorf("verifying queries with QUERY_RANGES")
+	}
+}
+
+/* A slow server makes the workers wait for responses, which must not be
+   blamed on the generator; a saturated generator must be. */
+func TestHealth(t *testing.T) {
+	var srv *fakedb.Server = startTestServer(t)
+	defer srv.Close()
+	srv.SetFaults(fakedb.Faults{Delay: 5 * time.Millisecond})
+	for _, mode := range SendModes {
+		var cfg Config = testConfig(t, "insert", srv.Addr(), 2)
+		cfg.TOTAL_RECORDS = 4096
+		cfg.MAX_CONCURRENT_MESSAGES = 1
+		cfg.SEND_MODE = mode
+		var result Result = run(t, context.Background(), cfg)
+		var h HealthStats = result.Health
+		if !result.Pass || h.Workers != 2 || h.Connections != 1 || h.SendMode != mode || h.MaxGoroutines == 0 || h.Overlapped {
+			t.Fatalf("%v: %+v", mode, h)
+		}
+		if h.WorkerTime <= 0 || h.Encode <= 0 || h.Decode <= 0 || h.ResponseWait < h.WorkerTime / 2 {
+			t.Errorf("%v: the workers of a slow server ran for %v and waited %v for responses", mode, h.WorkerTime, h.ResponseWait)
+		}
+		if len(h.Warnings) != 0 {
+			t.Errorf("%v: blamed the generator for a slow server: %v", mode, h.Warnings)
+		}
+	}
+
+	/* Runs at the same time share the GC and the goroutines of the process. */
+	var results []Result = make([]Result, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		var cfg Config = testConfig(t, "insert", srv.Addr(), 2)
+		cfg.Name = fmt.Sprintf("run%v", i)
+		for j := range cfg.UUIDS {
+			cfg.UUIDS[j] = uuid.NewSHA1(uuid.NameSpace_OID, []byte(fmt.Sprintf("%v%v", cfg.Name, j)))
+		}
+		cfg.TOTAL_RECORDS = 4096
+		cfg.MAX_CONCURRENT_MESSAGES = 1
+		r, err := NewRunner(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func (i int) {
+			defer wg.Done()
+			results[i] = r.Run(context.Background())
+		}(i)
+	}
+	wg.Wait()
+	for i, result := range results {
+		if !result.Pass || !result.Health.Overlapped {
+			t.Errorf("run %v at the same time as another: pass = %v, overlapped = %v", i, result.Pass, result.Health.Overlapped)
+		}
+	}
+
+	var second time.Duration = time.Second
+	for _, test := range []struct {
+		name string
+		health HealthStats
+		warning string
+	}{
+		{"waiting", HealthStats{Workers: 2, Connections: 1, WorkerTime: 2 * second, ResponseWait: 3 * second / 2, Decode: second / 10}, ""},
+		{"paced", HealthStats{Workers: 2, Connections: 1, WorkerTime: 2 * second, PaceWait: 3 * second / 2}, ""},
+		{"busy", HealthStats{Workers: 2, Connections: 1, WorkerTime: 2 * second, ResponseWait: second / 10}, "workers were busy"},
+		{"lock", HealthStats{Workers: 2, Connections: 1, SendMode: "mutex", WorkerTime: 2 * second, ResponseWait: second, LockWait: second * 3 / 4}, "waiting for the send lock 38% of the time; the connections they share are the limit, so use more TCP_CONNECTIONS or SEND_MODE=batch"},
+		{"queue", HealthStats{Workers: 2, Connections: 1, SendMode: "batch", WorkerTime: 2 * second, ResponseWait: second, LockWait: second * 3 / 4}, "waiting for room in the queue 38% of the time; the connections they share are the limit, so use more TCP_CONNECTIONS"},
+		{"decoding", HealthStats{Workers: 2, Connections: 2, WorkerTime: 2 * second, ResponseWait: 2 * second, Decode: 19 * second / 10}, "receive loops"},
+		{"gc", HealthStats{Workers: 2, Connections: 1, WorkerTime: 2 * second, ResponseWait: 2 * second, GCPause: second / 10}, "garbage collection"},
+		{"gc of other runs", HealthStats{Workers: 2, Connections: 1, WorkerTime: 2 * second, ResponseWait: 2 * second, GCPause: second / 10, Overlapped: true}, ""},
+	} {
+		var warnings []string = test.health.diagnose(second)
+		if test.warning == "" && len(warnings) != 0 || test.warning != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], test.warning)) {
+			t.Errorf("%v: %q, want a warning with %q", test.name, warnings, test.warning)
+		}
+	}
+}
+
+/* The servers that NewRunner routes numStreams streams to, in every mode, with
+   numServers servers. */
+func routedServers(t *testing.T, mode string, numServers int, numStreams int, routes map[string]string) ([]int, error) {
+	var cfg Config = DefaultConfig()
+	cfg.Command = "insert"
+	cfg.ROUTING = mode
+	cfg.ROUTES = routes
+	for s := 0; s < numServers; s++ {
+		cfg.DB_ADDRS = append(cfg.DB_ADDRS, fmt.Sprintf("db%v:4410", s))
+	}
+	for j := 0; j < numStreams; j++ {
+		cfg.UUIDS = append(cfg.UUIDS, uuid.NewSHA1(uuid.NameSpace_OID, []byte(fmt.Sprintf("stream%v", j))))
+	}
+	r, err := NewRunner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r.streamServers, nil
+}
+
+func TestRouting(t *testing.T) {
+	const numStreams = 1000
+	var ids []uuid.UUID
+	for j := 0; j < numStreams; j++ {
+		ids = append(ids, uuid.NewSHA1(uuid.NameSpace_OID, []byte(fmt.Sprintf("stream%v", j))))
+	}
+	modulo, _ := routedServers(t, "modulo", 3, numStreams, nil)
+	roundrobin, _ := routedServers(t, "roundrobin", 3, numStreams, nil)
+	hash, _ := routedServers(t, "hash", 3, numStreams, nil)
+	for j := range ids {
+		if modulo[j] != int(ids[j][0]) % 3 || roundrobin[j] != j % 3 {
+			t.Fatalf("stream %v: modulo %v, roundrobin %v", j, modulo[j], roundrobin[j])
+		}
+	}
+	var streams []int = make([]int, 3)
+	for _, s := range hash {
+		streams[s]++
+	}
+	for s, n := range streams {
+		if n < numStreams / 3 / 2 {
+			t.Errorf("hash gave server %v only %v of %v streams", s, n, numStreams)
+		}
+	}
+
+	/* Routes may be in any case; streams without one are hashed. */
+	var routes map[string]string = map[string]string{
+		strings.ToUpper(ids[0].String()): "db2:4410",
+		"urn:uuid:" + ids[1].String(): "db0:4410",
+	}
+	mapped, err := routedServers(t, "map", 3, numStreams, routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped[0] != 2 || mapped[1] != 0 {
+		t.Errorf("mapped streams went to %v and %v, want 2 and 0", mapped[0], mapped[1])
+	}
+	for j := 2; j < numStreams; j++ {
+		if mapped[j] != hash[j] {
+			t.Fatalf("stream %v without a route went to %v, hashed to %v", j, mapped[j], hash[j])
+		}
+	}
+	for _, bad := range []map[string]string{
+		{"not-a-uuid": "db0:4410"},
+		{ids[0].String(): "db0:4410", strings.ToUpper(ids[0].String()): "db1:4410"},
+		{ids[0].String(): "elsewhere:4410"},
+	} {
+		if _, err := routedServers(t, "map", 3, numStreams, bad); err == nil {
+			t.Errorf("routed with ROUTES %v", bad)
+		}
+	}
+}
+
+/* Adding a server to the hash ring only moves the streams it takes over,
+   about 1/n of them. */
+func TestHashRingMoves(t *testing.T) {
+	const numStreams = 2000
+	for numServers := 2; numServers <= 8; numServers *= 2 {
+		before, _ := routedServers(t, "hash", numServers, numStreams, nil)
+		after, _ := routedServers(t, "hash", numServers + 1, numStreams, nil)
+		var moved int
+		for j := range before {
+			if after[j] != before[j] {
+				moved++
+				if after[j] != numServers {
+					t.Fatalf("%v servers: stream %v moved from %v to %v instead of the new server", numServers, j, before[j], after[j])
+				}
+			}
+		}
+		var expected float64 = float64(numStreams) / float64(numServers + 1)
+		if float64(moved) < expected / 2 || float64(moved) > expected * 3 / 2 {
+			t.Errorf("%v servers: adding one moved %v of %v streams, expected about %.0f", numServers, moved, numStreams, expected)
+		}
+	}
+}
+
+/* Streams go to servers 0 and 1 in turn; in mixed mode every stream has two
+   workers, an inserter and then a querier. */
+func TestAssignConnections(t *testing.T) {
+	for _, test := range []struct {
+		assignment string
+		tcpConnections int
+		workerPoints []int64
+		conns []int
+		numConns []int
+	}{
+		{"roundrobin", 3, []int64{1, 1, 1, 1}, []int{0, 0, 1, 1}, []int{2, 2}},
+		{"roundrobin", 3, []int64{1, 1, 1, 1, 1, 1, 1, 1}, []int{0, 0, 1, 1, 2, 2, 0, 0}, []int{3, 3}},
+		{"perstream", 1, []int64{1, 1, 1, 1, 1, 1, 1, 1}, []int{0, 0, 1, 1, 0, 0, 1, 1}, []int{2, 2}},
+		{"leastloaded", 2, []int64{8, 8, 1, 1, 1, 1, 1, 1}, []int{0, 0, 1, 1, 1, 1, 1, 1}, []int{2, 2}},
+		{"leastloaded", 2, []int64{1, 1, 1, 1, 8, 8, 1, 1}, []int{0, 0, 1, 1, 0, 0, 1, 1}, []int{2, 2}},
+		{"dedicated", 2, []int64{1, 1, 1, 1}, []int{0, 0, 1, 1}, []int{2, 2}},
+		{"dedicated", 2, []int64{1, 1, 1, 1, 1, 1, 1, 1}, []int{0, 0, 1, 1, 2, 2, 3, 3}, []int{4, 4}},
+	} {
+		var cfg Config = testConfig(t, "insert", "db0:4410", 4)
+		cfg.DB_ADDRS = append(cfg.DB_ADDRS, "db1:4410")
+		cfg.ROUTING = "roundrobin"
+		cfg.CONN_ASSIGNMENT = test.assignment
+		cfg.TCP_CONNECTIONS = test.tcpConnections
+		r, err := NewRunner(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns, numConns := r.assignConnections(len(test.workerPoints), test.workerPoints)
+		if !reflect.DeepEqual(conns, test.conns) || !reflect.DeepEqual(numConns, test.numConns) {
+			t.Errorf("%v with %v connections and %v workers: %v using %v connections, want %v using %v",
+				test.assignment, test.tcpConnections, len(test.workerPoints), conns, numConns, test.conns, test.numConns)
+		}
+	}
+}
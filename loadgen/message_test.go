@@ -0,0 +1,543 @@
+package loadgen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* A Runner that is never run, for testing how it builds and checks messages. */
+func newTestRunner(t *testing.T, cfg Config) *Runner {
+	cfg.DB_ADDRS = []string{"localhost:4410"}
+	cfg.UUIDS = [][]byte{[]byte("0123456789abcdef")}
+	if cfg.Command == "" {
+		cfg.Command = "insert"
+	}
+	r, err := NewRunner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestBitLength(t *testing.T) {
+	for _, test := range []struct {
+		x int64
+		want uint
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{3, 2},
+		{4, 3},
+		{255, 8},
+		{256, 9},
+		{math.MaxInt64, 63},
+	} {
+		if got := bitLength(test.x); got != test.want {
+			t.Errorf("bitLength(%v) = %v, want %v", test.x, got, test.want)
+		}
+	}
+}
+
+func TestEchoTags(t *testing.T) {
+	for _, test := range []struct {
+		numMessages int64
+		bits uint
+	}{
+		{1, 0},
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{5, 3},
+		{4096, 12},
+		{4097, 13},
+	} {
+		var r *Runner = newTestRunner(t, DefaultConfig())
+		r.setNumMessages(test.numMessages)
+		if r.orderBitlength != test.bits {
+			t.Errorf("%v messages: %v order bits, want %v", test.numMessages, r.orderBitlength, test.bits)
+			continue
+		}
+		/* Every message of every worker needs its own echo tag, which tells
+		   both apart again. */
+		var messages []uint64
+		for _, j := range []uint64{0, 1, uint64(test.numMessages) / 2, uint64(test.numMessages) - 1} {
+			if j < uint64(test.numMessages) && (len(messages) == 0 || j > messages[len(messages) - 1]) {
+				messages = append(messages, j)
+			}
+		}
+		var seen map[uint64]bool = make(map[uint64]bool)
+		for _, worker := range []int{0, 1, 2, 7, 1000} {
+			for _, j := range messages {
+				var tag uint64 = r.echoTag(worker, j)
+				if tag >> test.bits != uint64(worker) {
+					t.Errorf("%v messages: echo tag %#x of message %v of worker %v does not start with the worker", test.numMessages, tag, j, worker)
+				}
+				id, message := r.splitEchoTag(tag)
+				if id != uint64(worker) || message != j {
+					t.Errorf("%v messages: echo tag %#x of message %v of worker %v splits into message %v of worker %v", test.numMessages, tag, j, worker, message, id)
+				}
+				if seen[tag] {
+					t.Errorf("%v messages: echo tag %#x is used twice", test.numMessages, tag)
+				}
+				seen[tag] = true
+			}
+		}
+	}
+}
+
+/* NewRunner must refuse what would make echo tags collide or verification
+   expect points that were never inserted, and say which setting is wrong. */
+func TestCheck(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		change func (cfg *Config)
+		key string
+	}{
+		{"default", func (cfg *Config) {}, ""},
+		{"unknown command", func (cfg *Config) { cfg.Command = "upsert" }, "-"},
+		{"no servers", func (cfg *Config) { cfg.DB_ADDRS = nil }, "DB_ADDR"},
+		{"short UUID", func (cfg *Config) { cfg.UUIDS[2] = cfg.UUIDS[2][:8] }, "UUID3"},
+		{"no connections", func (cfg *Config) { cfg.TCP_CONNECTIONS = 0 }, "TCP_CONNECTIONS"},
+		{"negative duration", func (cfg *Config) { cfg.DURATION = -time.Second }, "DURATION"},
+		{"unknown send mode", func (cfg *Config) { cfg.SEND_MODE = "fast" }, "SEND_MODE"},
+		{"data and pattern", func (cfg *Config) {
+			cfg.DataFiles = []string{"points.csv"}
+			cfg.TIME_PATTERN, _ = ParseTimePattern("gaps=100/100000000")
+		}, "TIME_PATTERN"},
+		{"verified ranges", func (cfg *Config) {
+			cfg.Command = "verify"
+			cfg.QUERY_RANGES, _ = ParseQueryRanges("span=1ms/10s")
+		}, "QUERY_RANGES"},
+		{"echo tags", func (cfg *Config) { cfg.TOTAL_RECORDS, cfg.POINTS_PER_MESSAGE = 1 << 62, 1 }, "-"},
+		{"echo tags with access", func (cfg *Config) {
+			cfg.TOTAL_RECORDS, cfg.POINTS_PER_MESSAGE = 1 << 60, 1
+			cfg.QUERY_ACCESS = QueryAccess{StreamSkew: 1}
+			cfg.Command = "query"
+		}, "-"},
+		{"echo tags of a delete", func (cfg *Config) { cfg.TOTAL_RECORDS, cfg.POINTS_PER_MESSAGE, cfg.Command = 1 << 62, 1, "delete" }, ""},
+		{"offset", func (cfg *Config) { cfg.MAX_TIME_RANDOM_OFFSET = cfg.NANOS_BETWEEN_POINTS }, "MAX_TIME_RANDOM_OFFSET"},
+		{"permuted nondeterministic", func (cfg *Config) { cfg.Command, cfg.PERM_SEED, cfg.DETERMINISTIC_KV = "verify", 3, false }, "PERM_SEED"},
+		{"permuted deterministic", func (cfg *Config) { cfg.Command, cfg.PERM_SEED, cfg.DETERMINISTIC_KV = "verify", 3, true }, ""},
+		{"statistical query length", func (cfg *Config) { cfg.Command, cfg.STATISTICAL_PW, cfg.NANOS_BETWEEN_POINTS = "verify", 10, 1000; cfg.POINTS_PER_MESSAGE = 100 }, "STATISTICAL_PW"},
+		{"statistical first time", func (cfg *Config) { cfg.Command, cfg.STATISTICAL_PW, cfg.FIRST_TIME = "verify", 10, 7 << 10 + 1 }, "FIRST_TIME"},
+	} {
+		var cfg Config = DefaultConfig()
+		cfg.Command = "insert"
+		cfg.DB_ADDRS = []string{"localhost:4410"}
+		for i := 0; i < 8; i++ {
+			cfg.UUIDS = append(cfg.UUIDS, []byte(fmt.Sprintf("%016d", i)))
+		}
+		test.change(&cfg)
+		_, err := NewRunner(cfg)
+		var key string = ""
+		if err != nil {
+			key = "-"
+			if configErr, ok := err.(ConfigError); ok && configErr.Key != "" {
+				key = configErr.Key
+			}
+		}
+		if key != test.key {
+			t.Errorf("%v: %v, want a problem with %q", test.name, err, test.key)
+		}
+	}
+}
+
+func TestMessageStarts(t *testing.T) {
+	var cfg Config = DefaultConfig()
+	cfg.POINTS_PER_MESSAGE = 16
+	cfg.NANOS_BETWEEN_POINTS = 1000
+	cfg.FIRST_TIME = 5000
+	var sequential []int64 = []int64{5000, 21000, 37000, 53000, 69000, 85000, 101000, 117000}
+
+	for _, test := range []struct {
+		permSeed int64
+		sorted bool
+	}{
+		{0, true},
+		{1, false},
+		{42, false},
+	} {
+		cfg.PERM_SEED = test.permSeed
+		var r *Runner = newTestRunner(t, cfg)
+		var permGen *rand.Rand = rand.New(rand.NewSource(test.permSeed))
+		var first []int64 = r.messageStarts(permGen, 8)
+		var second []int64 = r.messageStarts(permGen, 8)
+
+		/* Each message starts where another one ends, whatever the order. */
+		for _, starts := range [][]int64{first, second} {
+			var got []int64 = append([]int64(nil), starts...)
+			sort.Slice(got, func (i int, j int) bool {
+				return got[i] < got[j]
+			})
+			if !equalTimes(got, sequential) {
+				t.Errorf("PERM_SEED %v: start times %v are not a permutation of %v", test.permSeed, starts, sequential)
+			}
+		}
+		if test.sorted != equalTimes(first, sequential) {
+			t.Errorf("PERM_SEED %v: start times %v, sorted = %v", test.permSeed, first, !test.sorted)
+		}
+
+		/* The same seed gives the same order in every run, but every worker
+		   gets an order of its own. */
+		var again []int64 = r.messageStarts(rand.New(rand.NewSource(test.permSeed)), 8)
+		if !equalTimes(first, again) {
+			t.Errorf("PERM_SEED %v: start times %v in one run and %v in another", test.permSeed, first, again)
+		}
+		if !test.sorted && equalTimes(first, second) {
+			t.Errorf("PERM_SEED %v: two workers both got start times %v", test.permSeed, first)
+		}
+	}
+}
+
+func equalTimes(x []int64, y []int64) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type point struct {
+	time int64
+	value float64
+}
+
+/* Builds the insert messages of a worker with the given seed and returns the
+   points in them. */
+func insertPoints(t *testing.T, r *Runner, seed int64, starts []int64) []point {
+	var stream Stream = Stream{UUID: r.UUIDS[0], Rand: rand.New(rand.NewSource(seed)), Starts: starts}
+	var w WorkloadWorker = insertWorkload{r}.NewWorker(stream)
+	defer w.Close()
+	var points []point
+	for j := range starts {
+		seg, n := w.Next(uint64(j), r.echoTag(0, uint64(j)))
+		var req cpint.Request = cpint.ReadRootRequest(seg)
+		if req.Which() != cpint.REQUEST_INSERTVALUES || req.EchoTag() != r.echoTag(0, uint64(j)) || n != uint64(r.POINTS_PER_MESSAGE) {
+			t.Fatalf("message %v: request %v with echo tag %#x and %v points", j, req.Which(), req.EchoTag(), n)
+		}
+		for _, record := range req.InsertValues().Values().ToArray() {
+			points = append(points, point{record.Time(), record.Value()})
+		}
+	}
+	return points
+}
+
+func TestInsertRecords(t *testing.T) {
+	for _, test := range []struct {
+		deterministic bool
+		maxOffset int64
+	}{
+		{true, 0},
+		{true, 1000},
+		{false, 0},
+		{false, 1000},
+		{false, 999999},
+	} {
+		var cfg Config = DefaultConfig()
+		cfg.POINTS_PER_MESSAGE = 64
+		cfg.NANOS_BETWEEN_POINTS = 1000000
+		cfg.DETERMINISTIC_KV = test.deterministic
+		cfg.MAX_TIME_RANDOM_OFFSET = test.maxOffset
+		var r *Runner = newTestRunner(t, cfg)
+		r.setNumMessages(3)
+		var starts []int64 = r.messageStarts(nil, 3)
+		var points []point = insertPoints(t, r, 7, starts)
+		if len(points) != 3 * 64 {
+			t.Fatalf("%+v: %v points, want %v", test, len(points), 3 * 64)
+		}
+
+		/* Each point lies in its own slot of NANOS_BETWEEN_POINTS, perturbed
+		   by less than MAX_TIME_RANDOM_OFFSET unless the values are
+		   deterministic, and verification must be able to regenerate it from
+		   the same seed. */
+		var randGen *rand.Rand = rand.New(rand.NewSource(7))
+		var perturbed bool = false
+		for i, p := range points {
+			var slot int64 = r.FIRST_TIME + int64(i) * r.NANOS_BETWEEN_POINTS
+			var offset int64 = p.time - slot
+			if offset < 0 || (test.deterministic || test.maxOffset == 0) && offset != 0 || offset >= test.maxOffset && offset != 0 {
+				t.Errorf("%+v: point %v at %v is %v after its slot", test, i, p.time, offset)
+			}
+			perturbed = perturbed || offset != 0
+			var expTime int64 = r.getExpTime(slot, randGen)
+			var expected float64 = r.get_time_value(expTime, randGen)
+			if expTime != p.time || expected != p.value {
+				t.Errorf("%+v: point %v is (%v, %v), verification expects (%v, %v)", test, i, p.time, p.value, expTime, expected)
+			}
+		}
+		if !test.deterministic && test.maxOffset > 1 && !perturbed {
+			t.Errorf("%+v: no point was perturbed", test)
+		}
+	}
+}
+
+type window struct {
+	time int64
+	min, mean, max float64
+	count uint64
+}
+
+/* What a server returns for a statistical query over [start, end). */
+func windows(points []point, start int64, end int64, pw uint8) []window {
+	var result []window
+	for _, p := range points {
+		if p.time < start || p.time >= end {
+			continue
+		}
+		var time int64 = p.time &^ (int64(1) << pw - 1)
+		if len(result) == 0 || result[len(result) - 1].time != time {
+			result = append(result, window{time: time, min: math.Inf(1), max: math.Inf(-1)})
+		}
+		var w *window = &result[len(result) - 1]
+		w.min = math.Min(w.min, p.value)
+		w.max = math.Max(w.max, p.value)
+		w.mean += p.value
+		w.count++
+	}
+	for i := range result {
+		result[i].mean /= float64(result[i].count)
+	}
+	return result
+}
+
+func statisticalResponse(echoTag uint64, windows []window) cpint.Response {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var resp cpint.Response = cpint.NewRootResponse(seg)
+	resp.SetEchoTag(echoTag)
+	resp.SetStatusCode(cpint.STATUSCODE_OK)
+	resp.SetFinal(true)
+	var records cpint.StatisticalRecords = cpint.NewStatisticalRecords(seg)
+	var list cpint.StatisticalRecord_List = cpint.NewStatisticalRecordList(seg, len(windows))
+	for i, w := range windows {
+		var record cpint.StatisticalRecord = cpint.NewStatisticalRecord(seg)
+		record.SetTime(w.time)
+		record.SetMin(w.min)
+		record.SetMean(w.mean)
+		record.SetMax(w.max)
+		record.SetCount(w.count)
+		list.Set(i, record)
+	}
+	records.SetValues(list)
+	resp.SetStatisticalRecords(records)
+	return resp
+}
+
+/* Checks that the statistical records that a worker expects are the ones
+   that a server computes from the inserted points, in every 2^pw window of
+   every message. */
+func TestStatisticalExpectations(t *testing.T) {
+	for _, test := range []struct {
+		deterministic bool
+		maxOffset int64
+		pw int
+		windows int // per message
+	}{
+		{true, 0, 16, 16},
+		{true, 0, 18, 4},
+		{true, 0, 20, 1},
+		{false, 0, 16, 16},
+		{false, 0, 20, 1},
+		{false, 65535, 16, 16}, // points are perturbed, but stay in their window
+		{false, 65535, 18, 4},
+	} {
+		var cfg Config = DefaultConfig()
+		cfg.POINTS_PER_MESSAGE = 16
+		cfg.NANOS_BETWEEN_POINTS = 65536 // so a message is 2^20 long
+		cfg.DETERMINISTIC_KV = test.deterministic
+		cfg.MAX_TIME_RANDOM_OFFSET = test.maxOffset
+		cfg.STATISTICAL_PW = test.pw
+		cfg.Command = "verify"
+		var r *Runner = newTestRunner(t, cfg)
+		r.setNumMessages(3)
+		var starts []int64 = r.messageStarts(nil, 3)
+		var points []point = insertPoints(t, r, 11, starts)
+
+		var w WorkloadWorker = statQueryWorkload{r}.NewWorker(Stream{UUID: r.UUIDS[0], Rand: rand.New(rand.NewSource(11)), Starts: starts})
+		for j, start := range starts {
+			seg, n := w.Next(uint64(j), r.echoTag(0, uint64(j)))
+			var query cpint.CmdQueryStatisticalValues = cpint.ReadRootRequest(seg).QueryStatisticalValues()
+			if query.StartTime() != start || query.EndTime() != start + 1 << 20 || query.PointWidth() != uint8(test.pw) || n != uint64(test.windows) {
+				t.Errorf("%+v: message %v queries [%v, %v) at pw %v for %v records", test, j, query.StartTime(), query.EndTime(), query.PointWidth(), n)
+			}
+			var expected []window = windows(points, start, start + 1 << 20, uint8(test.pw))
+			if len(expected) != test.windows {
+				t.Fatalf("%+v: message %v has points in %v windows, want %v", test, j, len(expected), test.windows)
+			}
+			verified, ok := w.Verify(statisticalResponse(r.echoTag(0, uint64(j)), expected))
+			if !ok || verified != uint64(r.POINTS_PER_MESSAGE) {
+				t.Errorf("%+v: message %v: verified %v points, ok = %v", test, j, verified, ok)
+			}
+		}
+		w.Close()
+
+		/* A window that is off in any way must fail. */
+		for i, corrupt := range []func (*window){
+			func (w *window) { w.time += 1 << uint(test.pw) },
+			func (w *window) { w.min -= 0.5 },
+			func (w *window) { w.mean += 1e-9 },
+			func (w *window) { w.max += 0.5 },
+			func (w *window) { w.count++ },
+		} {
+			var w WorkloadWorker = statQueryWorkload{r}.NewWorker(Stream{UUID: r.UUIDS[0], Rand: rand.New(rand.NewSource(11)), Starts: starts})
+			var expected []window = windows(points, starts[0], starts[0] + 1 << 20, uint8(test.pw))
+			corrupt(&expected[len(expected) - 1])
+			if _, ok := w.Verify(statisticalResponse(r.echoTag(0, 0), expected)); ok {
+				t.Errorf("%+v: corruption %v went unnoticed", test, i)
+			}
+			w.Close()
+		}
+	}
+}
+
+/* An insert worker of one stream, with messages of pointsPerMessage points. */
+func newInsertWorker(tb testing.TB, pointsPerMessage uint32, deterministic bool) WorkloadWorker {
+	var cfg Config = DefaultConfig()
+	cfg.DB_ADDRS = []string{"localhost:4410"}
+	cfg.UUIDS = [][]byte{[]byte("0123456789abcdef")}
+	cfg.Command = "insert"
+	cfg.POINTS_PER_MESSAGE = pointsPerMessage
+	cfg.DETERMINISTIC_KV = deterministic
+	r, err := NewRunner(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r.setNumMessages(1)
+	var stream Stream = Stream{UUID: r.UUIDS[0], Rand: rand.New(rand.NewSource(1)), Starts: r.messageStarts(nil, 1)}
+	return insertWorkload{r}.NewWorker(stream)
+}
+
+/* A batch sender on a connection whose other end discards everything, with
+   the insert message that it sends. */
+func newDiscardingSender(pointsPerMessage uint32) (requestSender, *capnp.Segment, func ()) {
+	var cfg Config = DefaultConfig()
+	cfg.POINTS_PER_MESSAGE = pointsPerMessage
+	var r *Runner = &Runner{Config: cfg}
+	var mp InsertMessagePart = r.newInsertMessagePart().(InsertMessagePart)
+	client, server := net.Pipe()
+	go io.Copy(ioutil.Discard, server)
+	var sender requestSender = newRequestSender("batch", client, nil, ConnectionID{}, nil)
+	return sender, mp.segment, func () {
+		sender.close()
+		server.Close()
+	}
+}
+
+/* A response reader that reads the same encoded response over and over. */
+func newRepeatingResponseReader(tb testing.TB) (*responseReader, func ()) {
+	var windowsOfResponse []window = make([]window, 64)
+	for i := range windowsOfResponse {
+		windowsOfResponse[i] = window{time: int64(i) << 20, min: -1, mean: 0, max: 1, count: 1024}
+	}
+	var encoded bytes.Buffer
+	if _, err := statisticalResponse(1, windowsOfResponse).Segment.WriteTo(&encoded); err != nil {
+		tb.Fatal(err)
+	}
+	var stream *bytes.Reader = bytes.NewReader(nil)
+	var responses *responseReader = newResponseReader(stream)
+	return responses, func () {
+		stream.Reset(encoded.Bytes())
+		responses.reader.Reset(stream)
+	}
+}
+
+/* Building an insert message, sending it and reading a response must not
+   allocate once the buffers of the connection have grown. */
+func TestAllocs(t *testing.T) {
+	for _, deterministic := range []bool{true, false} {
+		var w WorkloadWorker = newInsertWorker(t, 4096, deterministic)
+		if allocs := testing.AllocsPerRun(100, func () { w.Next(0, 0) }); allocs != 0 {
+			t.Errorf("building an insert message (deterministic = %v) allocates %v times", deterministic, allocs)
+		}
+		w.Close()
+	}
+
+	sender, segment, stop := newDiscardingSender(4096)
+	var send = func () {
+		if err := sender.send(segment, 4096); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2 * (BATCH_QUEUE_LENGTH + BATCH_SPARE_BUFFERS); i++ {
+		send() // grow every buffer of the connection
+	}
+	if allocs := testing.AllocsPerRun(1000, send); allocs != 0 {
+		t.Errorf("sending an insert message allocates %v times", allocs)
+	}
+	stop()
+
+	responses, rewind := newRepeatingResponseReader(t)
+	var read = func () {
+		rewind()
+		resp, err := responses.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := cpint.ReadRootResponse(resp).StatisticalRecords().Values().Len(); n != 64 {
+			t.Fatalf("read %v records of 64", n)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, read); allocs != 0 {
+		t.Errorf("reading a response allocates %v times", allocs)
+	}
+}
+
+/* How fast one core builds insert messages; TestAllocs checks that it does
+   not allocate. */
+func BenchmarkInsertNext(b *testing.B) {
+	for _, deterministic := range []bool{true, false} {
+		b.Run(fmt.Sprintf("deterministic=%v", deterministic), func (b *testing.B) {
+			var w WorkloadWorker = newInsertWorker(b, 4096, deterministic)
+			defer w.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.Next(0, 0)
+			}
+			b.ReportMetric(float64(b.N) * 4096 / b.Elapsed().Seconds(), "points/s")
+		})
+	}
+}
+
+/* Queues insert messages on a connection whose other end discards them. */
+func BenchmarkBatchSend(b *testing.B) {
+	sender, segment, stop := newDiscardingSender(4096)
+	defer stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sender.send(segment, 4096); err != nil {
+			b.Fatal(err)
+		}
+	}
+	sender.close()
+	b.ReportMetric(float64(b.N) * 4096 / b.Elapsed().Seconds(), "points/s")
+}
+
+/* Reads responses through the buffers of a connection. */
+func BenchmarkReadResponse(b *testing.B) {
+	responses, rewind := newRepeatingResponseReader(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rewind()
+		if _, err := responses.next(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+/* What the database does with a point that is inserted at the same time as
+   one that it already holds:
+     keep     it keeps both, like BTrDB
+     replace  the new point replaces the old one */
+var DuplicatePolicies []string = []string{"keep", "replace"}
+
+/* A TimePattern makes the times of the points irregular, like those of real
+   sensors, to exercise the paths of the database that merge points into its
+   tree. Its zero value gives a point every NANOS_BETWEEN_POINTS. */
+type TimePattern struct {
+	/* After every GapEvery points, the sensor is out for GapLength ns. */
+	GapEvery int64
+	GapLength int64
+
+	/* Every BurstEvery points start with a burst: the first BurstPoints
+	   points after the first one follow BurstNanos apart instead of
+	   NANOS_BETWEEN_POINTS. */
+	BurstEvery int64
+	BurstPoints int64
+	BurstNanos int64
+
+	/* Each time between two points is NANOS_BETWEEN_POINTS (or BurstNanos)
+	   times a random factor between 1 - Jitter and 1 + Jitter. */
+	Jitter float64
+
+	/* The chance that a point has the same time as the one before it. */
+	Duplicates float64
+
+	/* The chance that a point is swapped with one of the ReorderDistance
+	   points after it, which may be in a later message. */
+	Reorder float64
+	ReorderDistance int64
+}
+
+/* Parses a TIME_PATTERN, a comma separated list of
+     gaps=<every>/<length ns>
+     bursts=<every>/<points>/<ns between them>
+     jitter=<fraction>
+     duplicates=<chance>
+     reorder=<chance>/<distance>
+   e.g. "gaps=10000/60000000000, duplicates=0.01". An empty string or "none"
+   is the zero TimePattern. */
+func ParseTimePattern(value string) (TimePattern, error) {
+	var p TimePattern
+	if strings.TrimSpace(value) == "none" {
+		return p, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var kv []string = strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("expected <name>=<values>, got %q", part)
+		}
+		var args []string = strings.Split(kv[1], "/")
+		var ints []int64
+		var floats []float64
+		var err error
+		switch kv[0] {
+		case "gaps":
+			ints, err = parsePatternInts(args, 2)
+			if err == nil {
+				p.GapEvery, p.GapLength = ints[0], ints[1]
+			}
+		case "bursts":
+			ints, err = parsePatternInts(args, 3)
+			if err == nil {
+				p.BurstEvery, p.BurstPoints, p.BurstNanos = ints[0], ints[1], ints[2]
+				if p.BurstPoints >= p.BurstEvery {
+					err = fmt.Errorf("a burst must have fewer than %v points", p.BurstEvery)
+				}
+			}
+		case "jitter":
+			floats, err = parsePatternFloats(args, 1)
+			if err == nil {
+				p.Jitter = floats[0]
+				if p.Jitter >= 1 {
+					err = fmt.Errorf("must be less than 1")
+				}
+			}
+		case "duplicates":
+			floats, err = parsePatternFloats(args, 1)
+			if err == nil {
+				p.Duplicates = floats[0]
+				if p.Duplicates > 1 {
+					err = fmt.Errorf("a chance must be at most 1")
+				}
+			}
+		case "reorder":
+			if len(args) == 2 {
+				floats, err = parsePatternFloats(args[:1], 1)
+				if err == nil {
+					ints, err = parsePatternInts(args[1:], 1)
+				}
+			} else {
+				err = fmt.Errorf("expected 2 values separated by /")
+			}
+			if err == nil {
+				p.Reorder, p.ReorderDistance = floats[0], ints[0]
+				if p.Reorder > 1 {
+					err = fmt.Errorf("a chance must be at most 1")
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown (expected gaps, bursts, jitter, duplicates or reorder)")
+		}
+		if err != nil {
+			return p, fmt.Errorf("%v: %v", kv[0], err)
+		}
+	}
+	return p, nil
+}
+
+func parsePatternInts(args []string, n int) ([]int64, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("expected %v values separated by /", n)
+	}
+	var ints []int64 = make([]int64, n)
+	for i, arg := range args {
+		var err error
+		ints[i], err = strconv.ParseInt(strings.TrimSpace(arg), 0, 64)
+		if err != nil || ints[i] <= 0 {
+			return nil, fmt.Errorf("expected a positive integer, got %q", arg)
+		}
+	}
+	return ints, nil
+}
+
+func parsePatternFloats(args []string, n int) ([]float64, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("expected %v values separated by /", n)
+	}
+	var floats []float64 = make([]float64, n)
+	for i, arg := range args {
+		var err error
+		floats[i], err = strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil || floats[i] < 0 {
+			return nil, fmt.Errorf("expected a nonnegative number, got %q", arg)
+		}
+	}
+	return floats, nil
+}
+
+func (p TimePattern) IsZero() bool {
+	return p == TimePattern{}
+}
+
+/* Returns n points that follow the pattern from firstTime, in the order in
+   which they are inserted. */
+func (p TimePattern) generate(n int64, firstTime int64, nanos int64, randGen *rand.Rand, value func (int64, *rand.Rand) float64) *Series {
+	var series *Series = &Series{Times: make([]int64, n), Values: make([]float64, n)}
+	var t int64 = firstTime
+	for i := int64(0); i < n; i++ {
+		if i > 0 && (p.Duplicates == 0 || randGen.Float64() >= p.Duplicates) {
+			var step int64 = nanos
+			if p.BurstEvery != 0 && i % p.BurstEvery != 0 && i % p.BurstEvery <= p.BurstPoints {
+				step = p.BurstNanos
+			}
+			if p.Jitter != 0 {
+				step = int64(float64(step) * (1 + p.Jitter * (2 * randGen.Float64() - 1)))
+			}
+			if step < 1 {
+				step = 1
+			}
+			if p.GapEvery != 0 && i % p.GapEvery == 0 {
+				step += p.GapLength
+			}
+			t += step
+		}
+		series.Times[i] = t
+		series.Values[i] = value(t, randGen)
+	}
+	if p.Reorder != 0 {
+		for i := int64(0); i < n - 1; i++ {
+			if randGen.Float64() < p.Reorder {
+				var j int64 = i + 1 + randGen.Int63n(p.ReorderDistance)
+				if j >= n {
+					j = n - 1
+				}
+				series.Times[i], series.Times[j] = series.Times[j], series.Times[i]
+				series.Values[i], series.Values[j] = series.Values[j], series.Values[i]
+			}
+		}
+	}
+	return series
+}
+
+/* Gives every stream the points of TIME_PATTERN, with values of its own. */
+func (r *Runner) generatePattern() {
+	var seedGen *rand.Rand = rand.New(rand.NewSource(r.RAND_SEED))
+	var orders [][]int = r.insertOrders()
+	r.data = make([]*streamPoints, r.NUM_STREAMS)
+	for i := range r.data {
+		var series *Series = r.TIME_PATTERN.generate(r.numPoints(), r.FIRST_TIME, r.NANOS_BETWEEN_POINTS, rand.New(rand.NewSource(seedGen.Int63())), r.get_time_value)
+		r.data[i] = newStreamPoints(series, int(r.POINTS_PER_MESSAGE), r.duplicatePolicy() == "keep", orders[i])
+	}
+}
+
+/* DUPLICATES, or "keep" if it is not set. */
+func (r *Runner) duplicatePolicy() string {
+	if r.DUPLICATES == "" {
+		return "keep"
+	}
+	return r.DUPLICATES
+}
@@ -0,0 +1,250 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* QueryRanges give every query a length and a point width of its own, like
+   the zoom levels of a plot that someone keeps zooming in and out of. A query
+   still starts where it would without them (see QUERY_ACCESS), but covers
+   between MinSpan and MaxSpan ns, drawn log-uniformly so that every order of
+   magnitude is as likely. If MaxPW is set, the queries are statistical, with
+   a point width between MinPW and MaxPW drawn uniformly, whatever
+   STATISTICAL_PW is, and the report of the run has a line for every point
+   width. The responses to such queries cannot be verified. */
+type QueryRanges struct {
+	MinSpan int64
+	MaxSpan int64
+	MinPW int
+	MaxPW int // 0 leaves the queries as they are
+}
+
+/* Parses a QUERY_RANGES, a comma separated list of
+     span=<min>/<max>
+     pw=<min>/<max>
+   where a span is in ns or has a unit (ns, us, ms, s, m, h, d or y), e.g.
+   "span=1s/1y, pw=20/40". An empty string or "none" is the zero
+   QueryRanges. */
+func ParseQueryRanges(value string) (QueryRanges, error) {
+	var q QueryRanges
+	if strings.TrimSpace(value) == "none" {
+		return q, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var kv []string = strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return q, fmt.Errorf("expected <name>=<values>, got %q", part)
+		}
+		var args []string = strings.Split(kv[1], "/")
+		var err error
+		switch kv[0] {
+		case "span":
+			if len(args) != 2 {
+				err = fmt.Errorf("expected 2 values separated by /")
+				break
+			}
+			q.MinSpan, err = parseSpan(args[0])
+			if err == nil {
+				q.MaxSpan, err = parseSpan(args[1])
+			}
+			if err == nil && q.MinSpan > q.MaxSpan {
+				err = fmt.Errorf("the minimum is more than the maximum")
+			}
+		case "pw":
+			var ints []int64
+			ints, err = parsePatternInts(args, 2)
+			if err == nil {
+				q.MinPW, q.MaxPW = int(ints[0]), int(ints[1])
+				if q.MinPW > q.MaxPW || q.MaxPW > 62 {
+					err = fmt.Errorf("expected point widths from 1 to 62, the minimum first")
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown (expected span or pw)")
+		}
+		if err != nil {
+			return q, fmt.Errorf("%v: %v", kv[0], err)
+		}
+	}
+	return q, nil
+}
+
+var spanUnits []struct {
+	suffix string
+	nanos int64
+} = []struct {
+	suffix string
+	nanos int64
+}{
+	{"ns", 1},
+	{"us", int64(time.Microsecond)},
+	{"ms", int64(time.Millisecond)},
+	{"s", int64(time.Second)},
+	{"m", int64(time.Minute)},
+	{"h", int64(time.Hour)},
+	{"d", 24 * int64(time.Hour)},
+	{"y", 365 * 24 * int64(time.Hour)},
+}
+
+/* Parses a span like 1500000, 90s or 1y into ns. */
+func parseSpan(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	var number string = strings.TrimRight(value, "abcdefghijklmnopqrstuvwxyz")
+	var unit string = value[len(number):]
+	var nanos int64 = 1
+	if unit != "" {
+		nanos = 0
+		for _, u := range spanUnits {
+			if u.suffix == unit {
+				nanos = u.nanos
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || nanos == 0 || f * float64(nanos) < 1 || f * float64(nanos) > math.MaxInt64 / 2 {
+		return 0, fmt.Errorf("expected a positive span like 1500000, 90s or 1y, got %q", value)
+	}
+	return int64(f * float64(nanos)), nil
+}
+
+func (q QueryRanges) IsZero() bool {
+	return q == QueryRanges{}
+}
+
+/* Draws a span and a point width for each of n queries. Either is nil if
+   the ranges leave it alone. */
+func (q QueryRanges) draw(n int, permGen *rand.Rand) ([]int64, []uint8) {
+	var spans []int64
+	var pws []uint8
+	if q.MaxSpan != 0 {
+		spans = make([]int64, n)
+		var lo, hi float64 = math.Log(float64(q.MinSpan)), math.Log(float64(q.MaxSpan))
+		for i := range spans {
+			spans[i] = int64(math.Exp(lo + (hi - lo) * permGen.Float64()))
+			if spans[i] < q.MinSpan {
+				spans[i] = q.MinSpan
+			} else if spans[i] > q.MaxSpan {
+				spans[i] = q.MaxSpan
+			}
+		}
+	}
+	if q.MaxPW != 0 {
+		pws = make([]uint8, n)
+		for i := range pws {
+			pws[i] = uint8(q.MinPW + permGen.Intn(q.MaxPW - q.MinPW + 1))
+		}
+	}
+	return spans, pws
+}
+
+/* Sets the spans and point widths of the query workers of a run with
+   QUERY_RANGES; the workers that do not query are left alone. */
+func (r *Runner) queryRanges(permGen *rand.Rand, starts [][]int64, spans [][]int64, pws [][]uint8) {
+	for z := range starts {
+		if !isQueryWorkload(r.workloads[z / r.NUM_STREAMS]) {
+			continue
+		}
+		s, p := r.QUERY_RANGES.draw(len(starts[z]), permGen)
+		if s != nil {
+			spans[z] = s
+		}
+		pws[z] = p
+	}
+}
+
+/* The number of points that a query from start that covers span ns would
+   find among the generated points. */
+func (r *Runner) coveredPoints(start int64, span int64) int64 {
+	var end int64 = start + span
+	var last int64 = r.FIRST_TIME + r.numPoints() * r.NANOS_BETWEEN_POINTS
+	if start < r.FIRST_TIME {
+		start = r.FIRST_TIME
+	}
+	if end > last {
+		end = last
+	}
+	if end <= start {
+		return 0
+	}
+	return (end - start + r.NANOS_BETWEEN_POINTS - 1) / r.NANOS_BETWEEN_POINTS
+}
+
+/* The number of points that message j of a worker covers. */
+func (r *Runner) messagePoints(stream Stream, j uint64) int64 {
+	if stream.Spans == nil {
+		return int64(r.POINTS_PER_MESSAGE)
+	}
+	return r.coveredPoints(stream.Starts[j], stream.Spans[j])
+}
+
+/* The point width of message j of a statistical query worker. */
+func (r *Runner) messagePW(stream Stream, j uint64) uint8 {
+	if stream.PointWidths != nil {
+		return stream.PointWidths[j]
+	}
+	return r.pw
+}
+
+/* What the queries with one point width did, for the report of a run with
+   point widths in QUERY_RANGES. Throughput is over the whole run. */
+type PointWidthStats struct {
+	PW uint8
+	Queries uint64 // queries that got their final response
+	Records uint64 // statistical records in the responses
+	Latency time.Duration // mean time from sending a query to its final response
+}
+
+/* Counts a response with the given number of records to message j of a
+   worker with point widths. The counters are updated atomically, since every
+   connection has a goroutine of its own. */
+func (r *Runner) countPointWidth(w *worker, j uint64, records uint64, final bool) {
+	var stats *pwCounters = &r.pwCounters[w.stream.PointWidths[j]]
+	atomic.AddUint64(&stats.records, records)
+	if final {
+		atomic.AddUint64(&stats.queries, 1)
+		atomic.AddUint64(&stats.latency, uint64(time.Now().UnixNano() - atomic.LoadInt64(&w.sendTimes[j])))
+	}
+}
+
+type pwCounters struct {
+	queries uint64
+	records uint64
+	latency uint64 // ns, summed over queries
+}
+
+/* Returns the stats of every point width that was queried. */
+func (r *Runner) pointWidthStats() []PointWidthStats {
+	var stats []PointWidthStats
+	for pw := range r.pwCounters {
+		var c *pwCounters = &r.pwCounters[pw]
+		var queries uint64 = atomic.LoadUint64(&c.queries)
+		if queries == 0 {
+			continue
+		}
+		stats = append(stats, PointWidthStats{
+			PW: uint8(pw),
+			Queries: queries,
+			Records: atomic.LoadUint64(&c.records),
+			Latency: time.Duration(atomic.LoadUint64(&c.latency) / queries),
+		})
+	}
+	return stats
+}
+
+func (r *Runner) printPointWidthReport(stats []PointWidthStats, duration time.Duration) {
+	r.printf("%-4s %10s %12s %14s %14s %14s\n", "PW", "Queries", "Queries/s", "Records", "Records/s", "Mean latency")
+	for _, s := range stats {
+		var seconds float64 = duration.Seconds()
+		r.printf("%-4d %10d %12.1f %14d %14.0f %14v\n", s.PW, s.Queries, float64(s.Queries) / seconds, s.Records, float64(s.Records) / seconds, s.Latency)
+	}
+}
@@ -0,0 +1,399 @@
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* A recording holds every request that a run sent, as it was sent, so that
+   the same load can be sent again later with Replay, whatever the settings
+   and seeds that made it. The file starts with recordingMagic, the number of
+   servers (uint32) and the address of each (uint16 length, then the bytes).
+   Then every request follows, in the order in which they were sent: the
+   nanoseconds since the start of the run (int64), the index of the server
+   and of the connection to it (uint32 each), the number of points in it
+   (uint64), and the request itself, framed like on the wire. Everything is
+   little endian. */
+const recordingMagic = "QLGREC1\n"
+
+type recordHeader struct {
+	Time int64
+	Server uint32
+	Connection uint32
+	Points uint64
+}
+
+type recorder struct {
+	lock sync.Mutex
+	file *os.File
+	writer *bufio.Writer
+	start time.Time
+	err error
+}
+
+func newRecorder(path string, dbAddrs []string) (*recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec *recorder = &recorder{file: file, writer: bufio.NewWriterSize(file, 1 << 20), start: time.Now()}
+	rec.writer.WriteString(recordingMagic)
+	binary.Write(rec.writer, binary.LittleEndian, uint32(len(dbAddrs)))
+	for _, addr := range dbAddrs {
+		binary.Write(rec.writer, binary.LittleEndian, uint16(len(addr)))
+		rec.writer.WriteString(addr)
+	}
+	return rec, nil
+}
+
+/* Appends a request that was just written to its connection. The sender of
+   the connection calls it while nothing else is written to the connection,
+   so the requests of a connection are recorded in the order in which they
+   went out. The segment may be reused as soon as this returns. */
+func (rec *recorder) record(connID ConnectionID, points uint64, segment *capnp.Segment) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if !rec.writeHeader(connID, points) {
+		return
+	}
+	if _, err := segment.WriteTo(rec.writer); err != nil {
+		rec.err = err
+	}
+}
+
+/* Like record, for a request that is already framed like on the wire. */
+func (rec *recorder) recordFrame(connID ConnectionID, points uint64, frame []byte) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if !rec.writeHeader(connID, points) {
+		return
+	}
+	if _, err := rec.writer.Write(frame); err != nil {
+		rec.err = err
+	}
+}
+
+/* Writes the header of the next request; called with the lock held. */
+func (rec *recorder) writeHeader(connID ConnectionID, points uint64) bool {
+	if rec.err != nil {
+		return false
+	}
+	var header recordHeader = recordHeader{
+		Time: int64(time.Since(rec.start)),
+		Server: uint32(connID.serverIndex),
+		Connection: uint32(connID.connectionIndex),
+		Points: points,
+	}
+	if err := binary.Write(rec.writer, binary.LittleEndian, &header); err != nil {
+		rec.err = err
+		return false
+	}
+	return true
+}
+
+/* Writes out what is left and returns the first error. */
+func (rec *recorder) close() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.err == nil {
+		rec.err = rec.writer.Flush()
+	}
+	if err := rec.file.Close(); rec.err == nil {
+		rec.err = err
+	}
+	return rec.err
+}
+
+/* Describes how to replay a recording. */
+type ReplayConfig struct {
+	Name string // printed before every line of output, if set
+	File string
+
+	/* The servers to send the requests to instead of the ones they were
+	   recorded against: either one for each of those, or one for all. */
+	DB_ADDRS []string
+
+	/* 1 sends every request at the time it was sent in the recording, 2 twice
+	   as fast, and so on. 0 sends them as fast as possible, without waiting
+	   for responses in between, so more may be in flight than in the
+	   recorded run. */
+	Speed float64
+}
+
+/* A connection of a replay, with the requests it is waiting for. */
+type replayConn struct {
+	connection net.Conn
+	sender requestSender
+	pending int64 // requests without a final response yet, updated atomically
+	errors uint64 // responses with a status code other than OK, updated atomically
+}
+
+/* Counts the requests of a replay that are still waiting for a response,
+   plus one until the last request is sent, and closes done once there are
+   none. */
+type replayWait struct {
+	outstanding int64
+	done chan struct{}
+}
+
+func (w *replayWait) add(n int64) {
+	if atomic.AddInt64(&w.outstanding, n) == 0 {
+		close(w.done)
+	}
+}
+
+/* Sends the requests of a recording again, on as many connections to each
+   server as were used to record it, and waits for every response. Result.Pass
+   is false if a server answered with an error status. */
+func Replay(parent context.Context, cfg ReplayConfig) Result {
+	var result Result = Result{Name: cfg.Name, Command: "replay"}
+	var printf = func (format string, args ...interface{}) {
+		if cfg.Name != "" {
+			format = "[" + cfg.Name + "] " + format
+		}
+		fmt.Printf(format, args...)
+	}
+	if cfg.Speed < 0 {
+		result.Err = fmt.Errorf("negative replay speed %v", cfg.Speed)
+		return result
+	}
+
+	file, err := os.Open(cfg.File)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer file.Close()
+	var reader *bufio.Reader = bufio.NewReaderSize(file, 1 << 20)
+	dbAddrs, err := readRecordingServers(reader)
+	if err != nil {
+		result.Err = fmt.Errorf("%v: %v", cfg.File, err)
+		return result
+	}
+	switch {
+	case len(cfg.DB_ADDRS) == 1:
+		for s := range dbAddrs {
+			dbAddrs[s] = cfg.DB_ADDRS[0]
+		}
+	case len(cfg.DB_ADDRS) == len(dbAddrs):
+		dbAddrs = cfg.DB_ADDRS
+	case len(cfg.DB_ADDRS) != 0:
+		result.Err = fmt.Errorf("%v was recorded against %v servers, but %v are given", cfg.File, len(dbAddrs), len(cfg.DB_ADDRS))
+		return result
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	var errLock sync.Mutex
+	var runErr error
+	var fail = func (err error) {
+		errLock.Lock()
+		if runErr == nil {
+			runErr = err
+		}
+		errLock.Unlock()
+		cancel()
+	}
+
+	/* Connections are dialed when the recording first uses them. Once the
+	   replay is cancelled, they are all closed, so that a send or a write to a
+	   server that stopped reading returns. Only this goroutine adds to conns,
+	   and it does so under connLock. */
+	var conns map[ConnectionID]*replayConn = make(map[ConnectionID]*replayConn)
+	var connLock sync.Mutex
+	var wait *replayWait = &replayWait{outstanding: 1, done: make(chan struct{})}
+	var readers sync.WaitGroup
+	var closed chan struct{} = make(chan struct{})
+	go func () {
+		<-ctx.Done()
+		connLock.Lock()
+		for _, c := range conns {
+			c.connection.Close()
+		}
+		connLock.Unlock()
+		close(closed)
+	}()
+	defer func () {
+		cancel()
+		<-closed
+		readers.Wait()
+	}()
+
+	var header recordHeader
+	var buf bytes.Buffer
+	var requests, late uint64
+	var maxLate time.Duration
+	var start, clock time.Time = time.Now(), time.Time{}
+	for ctx.Err() == nil {
+		err = binary.Read(reader, binary.LittleEndian, &header)
+		if err == io.EOF {
+			break
+		}
+		var segment *capnp.Segment
+		if err == nil {
+			segment, err = capnp.ReadFromStream(reader, &buf)
+		}
+		if err != nil {
+			fail(fmt.Errorf("%v: could not read request %v: %v", cfg.File, requests + 1, err))
+			break
+		}
+		if int(header.Server) >= len(dbAddrs) {
+			fail(fmt.Errorf("%v: request %v is for server %v of %v", cfg.File, requests + 1, header.Server, len(dbAddrs)))
+			break
+		}
+
+		var connID ConnectionID = ConnectionID{int(header.Server), int(header.Connection)}
+		var c *replayConn = conns[connID]
+		if c == nil {
+			connection, err := net.Dial("tcp", dbAddrs[connID.serverIndex])
+			if err != nil {
+				fail(fmt.Errorf("could not connect to database: %v", err))
+				break
+			}
+			printf("Created connection %v to %v\n", connID.connectionIndex, dbAddrs[connID.serverIndex])
+			c = &replayConn{connection: connection, sender: newRequestSender("batch", connection, nil, connID, ctx.Done())}
+			connLock.Lock()
+			conns[connID] = c
+			connLock.Unlock()
+			if ctx.Err() != nil { // cancelled before it was added
+				connection.Close()
+			}
+			readers.Add(1)
+			go func () {
+				defer readers.Done()
+				readReplayResponses(ctx, c, wait, fail)
+			}()
+		}
+
+		if cfg.Speed != 0 {
+			/* The clock starts with the first request, so the time it took
+			   the recorded run to get going does not count. */
+			if clock.IsZero() {
+				clock = time.Now().Add(-time.Duration(float64(header.Time) / cfg.Speed))
+			}
+			var due time.Time = clock.Add(time.Duration(float64(header.Time) / cfg.Speed))
+			if delay := time.Until(due); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					continue
+				}
+			} else if -delay > time.Millisecond {
+				late++
+				if -delay > maxLate {
+					maxLate = -delay
+				}
+			}
+		}
+
+		atomic.AddInt64(&c.pending, 1)
+		wait.add(1)
+		if err := c.sender.send(segment, header.Points); err != nil {
+			if ctx.Err() == nil {
+				fail(fmt.Errorf("could not send request: %v", err))
+			}
+			break
+		}
+		requests++
+		result.Points += header.Points
+	}
+
+	/* Wait for the responses to everything that was sent. */
+	wait.add(-1)
+	select {
+	case <-wait.done:
+	case <-ctx.Done():
+	}
+	result.Duration = time.Since(start)
+	for _, c := range conns {
+		if err := c.sender.close(); err != nil && ctx.Err() == nil {
+			fail(fmt.Errorf("could not send request: %v", err))
+		}
+	}
+	cancel()
+
+	var errorResponses uint64
+	for _, c := range conns {
+		errorResponses += atomic.LoadUint64(&c.errors)
+	}
+	errLock.Lock()
+	result.Err = runErr
+	errLock.Unlock()
+	result.Cancelled = parent.Err() != nil
+	result.Pass = result.Err == nil && !result.Cancelled && errorResponses == 0
+
+	printf("Replayed %v requests with %v points in %v\n", requests, result.Points, result.Duration)
+	if late != 0 {
+		printf("%v requests were sent late, by up to %v\n", late, maxLate)
+	}
+	if errorResponses != 0 {
+		printf("%v responses had an error status\n", errorResponses)
+	}
+	if result.Cancelled {
+		printf("Replay cancelled.\n")
+	}
+	return result
+}
+
+func readRecordingServers(reader io.Reader) ([]string, error) {
+	var magic []byte = make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != recordingMagic {
+		return nil, errors.New("not a recording")
+	}
+	var numServers uint32
+	if err := binary.Read(reader, binary.LittleEndian, &numServers); err != nil {
+		return nil, err
+	}
+	var dbAddrs []string
+	for s := uint32(0); s < numServers; s++ {
+		var length uint16
+		if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+			return nil, err
+		}
+		var addr []byte = make([]byte, length)
+		if _, err := io.ReadFull(reader, addr); err != nil {
+			return nil, err
+		}
+		dbAddrs = append(dbAddrs, string(addr))
+	}
+	return dbAddrs, nil
+}
+
+/* Counts the responses on a connection of a replay until it is closed. */
+func readReplayResponses(ctx context.Context, c *replayConn, wait *replayWait, fail func (error)) {
+	var buf bytes.Buffer
+	for {
+		responseSegment, err := capnp.ReadFromStream(c.connection, &buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fail(fmt.Errorf("could not receive response: %v", err))
+			return
+		}
+		var resp cpint.Response = cpint.ReadRootResponse(responseSegment)
+		if resp.StatusCode() != cpint.STATUSCODE_OK {
+			atomic.AddUint64(&c.errors, 1)
+		}
+		if resp.Final() {
+			if atomic.AddInt64(&c.pending, -1) < 0 {
+				fail(fmt.Errorf("received a response with echo tag %#x that no request is waiting for", resp.EchoTag()))
+				return
+			}
+			wait.add(-1)
+		}
+	}
+}
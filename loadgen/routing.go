@@ -0,0 +1,167 @@
+package loadgen
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+/* ROUTING selects which server each stream is sent to:
+     modulo      the first byte of the UUID modulo NUM_SERVERS (what we always did)
+     hash        consistent hashing with VIRTUAL_NODES points per server, so adding
+                 a server only moves the streams that the new server takes over
+     roundrobin  stream n goes to server n modulo NUM_SERVERS
+     map         ROUTE1, ROUTE2, ... list "<UUID>,<DB_ADDR>" pairs; streams that
+                 are not listed are placed with consistent hashing */
+var RoutingModes []string = []string{"modulo", "hash", "roundrobin", "map"}
+
+type ringPoint struct {
+	hash uint64
+	server int
+}
+
+/* A hash ring for consistent hashing. The points of a server only depend on
+   its address, not on its position in the DB_ADDR list. */
+type hashRing []ringPoint
+
+/* FNV-1a alone spreads keys that differ in a few bytes, like the virtual
+   nodes "<addr>#0", "<addr>#1", ..., badly over the ring, so its result is
+   mixed with the finalizer of MurmurHash3. */
+func hash64(data []byte) uint64 {
+	var h = fnv.New64a()
+	h.Write(data)
+	var x uint64 = h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func newHashRing(dbAddrs []string, virtualNodes int) hashRing {
+	var ring hashRing = make(hashRing, 0, len(dbAddrs) * virtualNodes)
+	for s, addr := range dbAddrs {
+		for v := 0; v < virtualNodes; v++ {
+			ring = append(ring, ringPoint{hash64([]byte(fmt.Sprintf("%v#%v", addr, v))), s})
+		}
+	}
+	sort.Slice(ring, func (i int, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return ring
+}
+
+/* Returns the server of the first point on the ring at or after the hash of the key. */
+func (ring hashRing) lookup(key []byte) int {
+	var h uint64 = hash64(key)
+	var i int = sort.Search(len(ring), func (i int) bool {
+		return ring[i].hash >= h
+	})
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].server
+}
+
+/* Parses a ROUTE<n> value of the form "<UUID>,<DB_ADDR>". */
+func ParseRoute(value string) (uuid.UUID, string, error) {
+	var parts []string = strings.SplitN(value, ",", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("expected <UUID>,<DB_ADDR>, got %q", value)
+	}
+	var id uuid.UUID = uuid.Parse(strings.TrimSpace(parts[0]))
+	if id == nil {
+		return nil, "", fmt.Errorf("invalid UUID %q", strings.TrimSpace(parts[0]))
+	}
+	return id, strings.TrimSpace(parts[1]), nil
+}
+
+/* Parses the UUIDs of ROUTES, which may be in any form that uuid.Parse
+   takes, and writes them the way routeStreams looks them up. */
+func normalizeRoutes(routes map[string]string) (map[string]string, error) {
+	var keys []string = make([]string, 0, len(routes))
+	for key := range routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // to report the same problem every time
+	var normalized map[string]string = make(map[string]string, len(routes))
+	for _, key := range keys {
+		var id uuid.UUID = uuid.Parse(strings.TrimSpace(key))
+		if id == nil {
+			return nil, fmt.Errorf("ROUTES: invalid UUID %q", key)
+		}
+		if addr, ok := normalized[id.String()]; ok && addr != routes[key] {
+			return nil, fmt.Errorf("ROUTES: %v is routed to both %v and %v", id, addr, routes[key])
+		}
+		normalized[id.String()] = routes[key]
+	}
+	return normalized, nil
+}
+
+/* Returns the index of the server of every stream. */
+func routeStreams(cfg Config) ([]int, error) {
+	var mode string = cfg.ROUTING
+	if mode == "" {
+		mode = "modulo"
+	}
+	var dbAddrs []string = cfg.DB_ADDRS
+	var servers []int = make([]int, len(cfg.UUIDS))
+	var ring hashRing
+	var routes map[string]int = make(map[string]int)
+	if mode == "hash" || mode == "map" {
+		if cfg.VIRTUAL_NODES <= 0 {
+			return nil, fmt.Errorf("VIRTUAL_NODES must be positive")
+		}
+		ring = newHashRing(dbAddrs, cfg.VIRTUAL_NODES)
+	}
+	if mode == "map" {
+		var indexes map[string]int = make(map[string]int)
+		for s, addr := range dbAddrs {
+			indexes[addr] = s
+		}
+		for id, addr := range cfg.ROUTES {
+			s, ok := indexes[addr]
+			if !ok {
+				return nil, fmt.Errorf("the route of %v: %v is not one of the DB_ADDRS", id, addr)
+			}
+			routes[id] = s
+		}
+	}
+	for j, id := range cfg.UUIDS {
+		switch mode {
+		case "modulo":
+			servers[j] = int(uint(id[0]) % uint(len(dbAddrs)))
+		case "roundrobin":
+			servers[j] = j % len(dbAddrs)
+		case "hash":
+			servers[j] = ring.lookup(id)
+		case "map":
+			s, ok := routes[uuid.UUID(id).String()]
+			if !ok {
+				s = ring.lookup(id)
+			}
+			servers[j] = s
+		default:
+			return nil, fmt.Errorf("unknown ROUTING %v", mode)
+		}
+	}
+	return servers, nil
+}
+
+/* Prints how many streams and points went to each server. */
+func (r *Runner) printServerReport(streamPoints []uint64) {
+	var streams []int = make([]int, r.NUM_SERVERS)
+	var points []uint64 = make([]uint64, r.NUM_SERVERS)
+	for j, s := range r.streamServers {
+		streams[s]++
+		points[s] += streamPoints[j]
+	}
+	r.printf("%-32s %10s %16s\n", "Server", "Streams", "Points")
+	for s, addr := range r.DB_ADDRS {
+		r.printf("%-32s %10d %16d\n", addr, streams[s], points[s])
+	}
+}
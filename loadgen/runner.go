@@ -0,0 +1,944 @@
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pborman/uuid"
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* A Runner runs one command against the servers. It holds the settings and
+   the state of the run, so several Runners can run at the same time. */
+type Runner struct {
+	/* Totals over the whole run. They are updated atomically, so they come
+	   first to be 64-bit aligned on 32-bit platforms as well. */
+	points_sent uint64
+	points_received uint64
+	points_verified uint64
+	pwCounters [64]pwCounters // for QUERY_RANGES with point widths
+	health healthCounters
+
+	Config
+
+	NUM_SERVERS int
+	NUM_STREAMS int
+	pw uint8
+
+	orderBitlength uint
+	orderBitmask uint64
+	statistical bool
+	statisticalBitmaskLower int64
+	statisticalBitmaskUpper int64
+
+	DELETE_POINTS bool
+	FLUSH_STREAMS bool
+
+	streamServers []int // index in DB_ADDRS of the server of each stream
+	data []*streamPoints // the points of each stream, if DataFiles or TIME_PATTERN is set
+	workloads []Workload // every stream has a worker for each
+	get_time_value func (int64, *rand.Rand) float64
+
+	/* Used to pace the workers when DURATION is set. */
+	startTime int64
+
+	verificationFailed uint32 // set to 1 by any goroutine that finds a wrong point
+
+	rec *recorder // set if RecordFile is
+
+	/* The first error that stopped the run, and how to stop it. */
+	errLock sync.Mutex
+	err error
+	cancel context.CancelFunc
+
+	insertPool sync.Pool
+	standQueryPool sync.Pool
+	statQueryPool sync.Pool
+}
+
+type TransactionData struct {
+	sendTime int64
+	respTime int64
+}
+
+type ConnectionID struct {
+	serverIndex int
+	connectionIndex int
+}
+
+/* The state of a worker that the runner keeps, next to that of its workload. */
+type worker struct {
+	current int64 // start time of the message being sent, set atomically; first to be 64-bit aligned
+	pointsSent uint64
+	nanosBetweenMessages int64 // paces the worker when POINTS_PER_SECOND is set
+	sendTimes []int64 // when each message was sent, set atomically, if it has point widths
+
+	stream Stream
+	load WorkloadWorker
+	sender requestSender
+	connID ConnectionID
+	cont chan uint64 // holds the sizes of the responses we are waiting for
+	history []TransactionData
+}
+
+/* An insert message is built once and then reused for every message of a
+   worker. Its list of records is already in place in the segment, and records
+   holds a view of each of them, so a new message only overwrites their times
+   and values where they are, instead of copying a record into every entry of
+   the list. Building a message allocates nothing. */
+type InsertMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	insert *cpint.CmdInsertValues
+	records []cpint.Record
+}
+
+func (r *Runner) newInsertMessagePart() interface{} {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var req cpint.Request = cpint.NewRootRequest(seg)
+	var insert cpint.CmdInsertValues = cpint.NewCmdInsertValues(seg)
+	insert.SetSync(false)
+	var recList cpint.Record_List = cpint.NewRecordList(seg, int(r.POINTS_PER_MESSAGE))
+	insert.SetValues(recList)
+	req.SetInsertValues(insert)
+	return InsertMessagePart{
+		segment: seg,
+		request: &req,
+		insert: &insert,
+		records: recList.ToArray(),
+	}
+}
+
+func getRandValue (time int64, randGen *rand.Rand) float64 {
+	// We technically don't need time anymore, but if we switch back to a sine wave later it's useful to keep it around as a parameter
+	return randGen.NormFloat64()
+}
+
+var sines [100]float64
+
+func init() {
+	for r := 0; r < 100; r++ {
+		sines[r] = math.Sin(2 * math.Pi * float64(r) / 100)
+	}
+}
+
+func (r *Runner) getSinusoidValue (time int64, randGen *rand.Rand) float64 {
+	/* The index comes from the time of the point rather than from a counter
+	   that all streams share, so the value of a point does not depend on the
+	   order in which the streams happen to run. */
+	var index int64 = ((time - r.FIRST_TIME) / r.NANOS_BETWEEN_POINTS + 1) % 100
+	if index < 0 {
+		index += 100
+	}
+	return sines[index]
+}
+
+func min64 (x1 int64, x2 int64) int64 {
+	if x1 < x2 {
+		return x1
+	} else {
+		return x2
+	}
+}
+
+/* Blocks until message j of a worker may be sent. Returns false if the run
+   has lasted DURATION or has been cancelled, and no more messages should be sent. */
+func (r *Runner) pace(ctx context.Context, w *worker, j uint64) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if r.DURATION != 0 && time.Now().UnixNano() - r.startTime >= int64(r.DURATION) {
+		return false
+	}
+	if w.nanosBetweenMessages != 0 {
+		var wait int64 = r.startTime + int64(j) * w.nanosBetweenMessages - time.Now().UnixNano()
+		if wait > 0 {
+			var timer *time.Timer = time.NewTimer(time.Duration(wait))
+			defer timer.Stop()
+			var waitStart time.Time = time.Now()
+			defer func () { atomic.AddUint64(&r.health.paceWait, since(waitStart)) }()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/* Takes a slot for a message of n points. Blocks if we haven't received enough
+   responses; returns false if the run is cancelled while waiting. */
+func acquire(ctx context.Context, cont chan uint64, n uint64) bool {
+	select {
+	case cont <- n:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/* Blocks until every message of a worker is fully processed, or the run is cancelled. */
+func (r *Runner) drain(ctx context.Context, cont chan uint64) {
+	var start time.Time = time.Now()
+	defer func () { atomic.AddUint64(&r.health.responseWait, since(start)) }()
+	for j := uint64(0); j < r.MAX_CONCURRENT_MESSAGES; j++ {
+		if !acquire(ctx, cont, 0) {
+			return
+		}
+	}
+}
+
+type QueryMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	query *cpint.CmdQueryStandardValues
+}
+
+func (r *Runner) newQueryMessagePart() interface{} {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var req cpint.Request = cpint.NewRootRequest(seg)
+	var query cpint.CmdQueryStandardValues = cpint.NewCmdQueryStandardValues(seg)
+	query.SetVersion(0)
+	req.SetQueryStandardValues(query)
+	return QueryMessagePart{
+		segment: seg,
+		request: &req,
+		query: &query,
+	}
+}
+
+type StatQueryMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	query *cpint.CmdQueryStatisticalValues
+}
+
+func (r *Runner) newStatQueryMessagePart() interface{} {
+	var seg *capnp.Segment = capnp.NewBuffer(nil)
+	var req cpint.Request = cpint.NewRootRequest(seg)
+	var query cpint.CmdQueryStatisticalValues = cpint.NewCmdQueryStatisticalValues(seg)
+	query.SetVersion(0)
+	query.SetPointWidth(r.pw)
+	req.SetQueryStatisticalValues(query)
+	return StatQueryMessagePart{
+		segment: seg,
+		request: &req,
+		query: &query,
+	}
+}
+
+/* Sends the messages of a worker, at most MAX_CONCURRENT_MESSAGES at a time. */
+func (r *Runner) sendMessages(ctx context.Context, w *worker, response chan ConnectionID) {
+	var started time.Time = time.Now()
+	var numMessages uint64 = uint64(len(w.stream.Starts))
+	var j uint64
+	for j = 0; j < numMessages && r.pace(ctx, w, j); j++ {
+		atomic.StoreInt64(&w.current, w.stream.Starts[j])
+		var encodeStart time.Time = time.Now()
+		segment, n := w.load.Next(j, r.echoTag(w.stream.Worker, j))
+		var waitStart time.Time = time.Now()
+		atomic.AddUint64(&r.health.encode, uint64(waitStart.Sub(encodeStart)))
+
+		var ok bool = acquire(ctx, w.cont, n)
+		atomic.AddUint64(&r.health.responseWait, since(waitStart))
+		if !ok {
+			break
+		}
+		if w.sendTimes != nil {
+			atomic.StoreInt64(&w.sendTimes[j], time.Now().UnixNano())
+		}
+
+		var sendErr error
+
+		sendErr = w.sender.send(segment, n)
+		if r.GET_MESSAGE_TIMES { // write send time to history
+			w.history[j].sendTime = time.Now().UnixNano()
+		}
+
+		if sendErr != nil {
+			if ctx.Err() == nil {
+				r.fail(fmt.Errorf("could not send request: %v", sendErr))
+			}
+			break
+		}
+		atomic.AddUint64(&r.points_sent, n)
+		w.pointsSent += uint64(r.messagePoints(w.stream, j))
+	}
+
+	w.load.Close()
+
+	r.drain(ctx, w.cont)
+	atomic.AddUint64(&r.health.workerTime, since(started))
+	response <- w.connID
+}
+
+func (r *Runner) getExpTime(currTime int64, randGen *rand.Rand) int64 {
+	if r.DETERMINISTIC_KV {
+		return currTime
+	} else {
+		return currTime + int64(randGen.Float64() * float64(r.MAX_TIME_RANDOM_OFFSET))
+	}
+}
+
+/* The tolerance is relative, so two zeros have to be compared exactly. */
+func floatEquals(x float64, y float64) bool {
+	return x == y || math.Abs(x - y) < 1e-14 * math.Max(math.Abs(x), math.Abs(y))
+}
+
+/* The size of the buffers that the responses on a connection are read
+   through. The buffer that a response is decoded from grows beyond it for
+   larger responses and then stays that large. */
+const RESPONSE_BUFFER_SIZE = 1 << 16
+
+/* Reads the responses on one connection. Its buffers and the segment that
+   responses are decoded into are kept for the whole run, so reading a
+   response allocates nothing, and reading through a bufio.Reader turns the
+   small reads of the framing into one read from the socket for many
+   responses. A response is only good until the next one is read. */
+type responseReader struct {
+	reader *bufio.Reader
+	data []byte
+	segment *capnp.Segment
+	buf bytes.Buffer // for responses of several segments, which capnp decodes
+}
+
+func newResponseReader(connection io.Reader) *responseReader {
+	return &responseReader{
+		reader: bufio.NewReaderSize(connection, RESPONSE_BUFFER_SIZE),
+		data: make([]byte, RESPONSE_BUFFER_SIZE),
+		segment: capnp.NewBuffer(nil),
+	}
+}
+
+func (rr *responseReader) next() (*capnp.Segment, error) {
+	header, err := rr.reader.Peek(8)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != 0 {
+		return capnp.ReadFromStream(rr.reader, &rr.buf)
+	}
+	var size uint64 = 8 * uint64(binary.LittleEndian.Uint32(header[4:8]))
+	if size > uint64(capnp.MaxTotalSize) {
+		return nil, capnp.ErrTooMuchData
+	}
+	rr.reader.Discard(8)
+	if uint64(cap(rr.data)) < size {
+		rr.data = make([]byte, size)
+	}
+	rr.data = rr.data[:size]
+	if _, err := io.ReadFull(rr.reader, rr.data); err != nil {
+		return nil, err
+	}
+	rr.segment.Data = rr.data
+	return rr.segment, nil
+}
+
+func (r *Runner) validateResponses(ctx context.Context, connection net.Conn, connID ConnectionID, connLock *sync.Mutex, workers []*worker, closed *uint32) {
+	var responses *responseReader = newResponseReader(connection)
+	for true {
+		/* I've restructured the code so that this is the only goroutine that receives from the connection.
+		   So, the locks aren't necessary anymore. But, I've kept the lock around in case we switch to a different
+		   design later on. */
+		//connLock.Lock()
+		responseSegment, respErr := responses.next()
+		//connLock.Unlock()
+
+		/* The connection is closed once every worker on it is done, or when the
+		   run is cancelled; either way the read fails and we stop. */
+		if atomic.LoadUint32(closed) != 0 || ctx.Err() != nil {
+			return
+		}
+
+		if respErr != nil {
+			r.fail(fmt.Errorf("could not receive response: %v", respErr))
+			return
+		}
+		var decodeStart time.Time = time.Now()
+
+		responseSeg := cpint.ReadRootResponse(responseSegment)
+		echoTag := responseSeg.EchoTag()
+		id, message := r.splitEchoTag(echoTag)
+		var final bool = responseSeg.Final()
+
+		/* A response that is not to a message that a worker on this
+		   connection sent means that we can no longer tell which responses
+		   belong to which messages. */
+		if id >= uint64(len(workers)) || workers[id].connID != connID || message >= uint64(len(workers[id].stream.Starts)) {
+			r.fail(fmt.Errorf("received a response with unknown echo tag %#x", echoTag))
+			return
+		}
+		var w *worker = workers[id]
+
+		if responseSeg.StatusCode() != cpint.STATUSCODE_OK {
+			r.fail(fmt.Errorf("Quasar returns status code %s for message %v of %v", responseSeg.StatusCode(), message, r.workerName(int(id))))
+			return
+		}
+
+		if r.VERIFY_RESPONSES {
+			verified, ok := w.load.Verify(responseSeg)
+			atomic.AddUint64(&r.points_verified, verified)
+			if !ok {
+				atomic.StoreUint32(&r.verificationFailed, 1)
+			}
+		}
+
+		if w.stream.PointWidths != nil {
+			r.countPointWidth(w, message, uint64(responseSeg.StatisticalRecords().Values().Len()), final)
+		}
+
+		if final {
+			var size uint64
+			select {
+			case size = <-w.cont:
+			default:
+				r.fail(fmt.Errorf("received a response to message %v of %v, which is not waiting for one", message, r.workerName(int(id))))
+				return
+			}
+			atomic.AddUint64(&r.points_received, size)
+			if r.GET_MESSAGE_TIMES {
+				w.history[message].respTime = time.Now().UnixNano()
+			}
+		}
+		atomic.AddUint64(&r.health.decode, since(decodeStart))
+	}
+}
+
+type DeleteMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	query *cpint.CmdDeleteValues
+}
+
+var deletePool sync.Pool = sync.Pool{
+	New: func () interface{} {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var req cpint.Request = cpint.NewRootRequest(seg)
+		var query cpint.CmdDeleteValues = cpint.NewCmdDeleteValues(seg)
+		req.SetEchoTag(0)
+		return DeleteMessagePart{
+			segment: seg,
+			request: &req,
+			query: &query,
+		}
+	},
+}
+
+type FlushMessagePart struct {
+	segment *capnp.Segment
+	request *cpint.Request
+	query *cpint.CmdFlush
+}
+
+var flushPool sync.Pool = sync.Pool{
+	New: func () interface{} {
+		var seg *capnp.Segment = capnp.NewBuffer(nil)
+		var req cpint.Request = cpint.NewRootRequest(seg)
+		var query cpint.CmdFlush = cpint.NewCmdFlush(seg)
+		req.SetEchoTag(0)
+		return FlushMessagePart{
+			segment: seg,
+			request: &req,
+			query: &query,
+		}
+	},
+}
+
+/* The times that a delete of stream covers: all of its points. */
+func (r *Runner) deleteRange(stream int) (int64, int64) {
+	if r.data != nil {
+		return r.data[stream].bounds[0], r.data[stream].bounds[len(r.data[stream].bounds) - 1]
+	}
+	return r.FIRST_TIME, r.FIRST_TIME + r.NANOS_BETWEEN_POINTS * r.TOTAL_RECORDS
+}
+
+func (r *Runner) getServer(stream int) int {
+	return r.streamServers[stream]
+}
+
+/* The echo tag of a message holds the index of its worker in the upper bits
+   and the index of the message in the lower orderBitlength bits, which are
+   just enough for numMessages messages. */
+func (r *Runner) setNumMessages(numMessages int64) {
+	r.orderBitlength = bitLength(numMessages - 1)
+	r.orderBitmask = (1 << r.orderBitlength) - 1
+}
+
+func (r *Runner) echoTag(worker int, j uint64) uint64 {
+	return uint64(worker) << r.orderBitlength | j
+}
+
+func (r *Runner) splitEchoTag(echoTag uint64) (uint64, uint64) {
+	return echoTag >> r.orderBitlength, echoTag & r.orderBitmask
+}
+
+/* Returns the start times of the messages of a worker, in the order in which
+   they are sent: in time order, or shuffled by permGen if PERM_SEED is set. */
+func (r *Runner) messageStarts(permGen *rand.Rand, numMessages int64) []int64 {
+	var starts []int64 = make([]int64, numMessages)
+	var messageLength int64 = r.NANOS_BETWEEN_POINTS * int64(r.POINTS_PER_MESSAGE)
+	var f int64
+	if r.PERM_SEED == 0 {
+		for f = 0; f < numMessages; f++ {
+			starts[f] = r.FIRST_TIME + messageLength * f
+		}
+	} else {
+		x := permGen.Perm(int(numMessages))
+		for f = 0; f < numMessages; f++ {
+			starts[f] = r.FIRST_TIME + messageLength * int64(x[f])
+		}
+	}
+	return starts
+}
+
+func bitLength(x int64) uint {
+	var times uint = 0
+	for x != 0 {
+		x >>= 1
+		times++
+	}
+	return times
+}
+
+/* Stops the run because of err. Only the first error is kept. */
+func (r *Runner) fail(err error) {
+	r.errLock.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.errLock.Unlock()
+	r.cancel()
+}
+
+func (r *Runner) getErr() error {
+	r.errLock.Lock()
+	defer r.errLock.Unlock()
+	return r.err
+}
+
+/* Prints a line of output, prefixed with the name of the run if it has one. */
+func (r *Runner) printf(format string, args ...interface{}) {
+	if r.Name != "" {
+		format = "[" + r.Name + "] " + format
+	}
+	fmt.Printf(format, args...)
+}
+
+/* Runs the command against the servers and blocks until it is done, ctx is
+   cancelled, or an error stops it. When it stops early, the workers stop
+   sending, every connection is closed, and the result covers what was done
+   until then. A Runner can only be run once. */
+func (r *Runner) Run(parent context.Context) Result {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	r.cancel = cancel
+	r.describe()
+
+	var DELETE_POINTS bool = r.DELETE_POINTS || r.FLUSH_STREAMS
+	var uuids [][]byte = r.UUIDS
+	var dbAddrs []string = r.DB_ADDRS
+	var NUM_STREAMS int = r.NUM_STREAMS
+	var NUM_SERVERS int = r.NUM_SERVERS
+	var FIRST_TIME int64 = r.FIRST_TIME
+
+	var remainder int64 = 0
+	if r.TOTAL_RECORDS % int64(r.POINTS_PER_MESSAGE) != 0 {
+		remainder = 1
+	}
+	var perm_size = (r.TOTAL_RECORDS / int64(r.POINTS_PER_MESSAGE)) + remainder
+	/* Every stream gets one worker per sender; in mixed mode, the inserting
+	   workers come first so that they get the same seeds and order as in insert mode. */
+	var numWorkers int = NUM_STREAMS * len(r.workloads)
+
+	var seedGen *rand.Rand = rand.New(rand.NewSource(r.RAND_SEED))
+	var permGen *rand.Rand = rand.New(rand.NewSource(r.PERM_SEED));
+
+	/* Work out every message before anything is sent. */
+	var perm [][]int64 = make([][]int64, numWorkers)
+	var spans [][]int64 = make([][]int64, numWorkers)
+	var pws [][]uint8 = make([][]uint8, numWorkers)
+	var workerPoints []int64 = make([]int64, numWorkers)
+	var totalPoints int64 = 0
+	if !DELETE_POINTS {
+		for e := 0; e < numWorkers; e++ {
+			perm[e] = r.messageStarts(permGen, perm_size)
+		}
+		if !r.QUERY_ACCESS.IsZero() {
+			r.queryAccess(permGen, perm_size, perm, spans)
+		}
+		if !r.QUERY_RANGES.IsZero() {
+			r.queryRanges(permGen, perm, spans, pws)
+		}
+		var maxMessages int64 = perm_size
+		for e := 0; e < numWorkers; e++ {
+			workerPoints[e] = int64(len(perm[e])) * int64(r.POINTS_PER_MESSAGE)
+			if spans[e] != nil {
+				workerPoints[e] = 0
+				for j := range spans[e] {
+					workerPoints[e] += r.coveredPoints(perm[e][j], spans[e][j])
+				}
+			}
+			totalPoints += workerPoints[e]
+			if int64(len(perm[e])) > maxMessages {
+				maxMessages = int64(len(perm[e]))
+			}
+		}
+		r.setNumMessages(maxMessages)
+		r.printf("Finished generating insert/query order\n");
+	} else {
+		/* One message per stream, which covers all of its points. */
+		for e := range workerPoints {
+			start, _ := r.deleteRange(e % NUM_STREAMS)
+			perm[e] = []int64{start}
+			workerPoints[e] = r.TOTAL_RECORDS
+		}
+		r.setNumMessages(1)
+	}
+
+	var j int
+	r.printf("Using UUIDs ")
+	for j = 0; j < NUM_STREAMS && j < 10; j++ {
+		fmt.Printf("%s ", uuid.UUID(uuids[j]).String())
+	}
+	if NUM_STREAMS > 10 {
+		fmt.Printf("... (%v streams)", NUM_STREAMS)
+	}
+	fmt.Printf("\n")
+
+	var workerNames []string = make([]string, numWorkers)
+	for j = 0; j < numWorkers; j++ {
+		workerNames[j] = r.workerName(j)
+	}
+
+	var serverIndex int = 0
+	var connIndex int
+
+	/* Decide which connection every worker uses first, so that we only dial
+	   the connections that are needed. */
+	workerConns, numConns := r.assignConnections(numWorkers, workerPoints)
+	var usingConn [][]int = make([][]int, NUM_SERVERS)
+	var connClosed [][]uint32 = make([][]uint32, NUM_SERVERS) // read by validateResponses, so set atomically
+	for y := 0; y < NUM_SERVERS; y++ {
+		usingConn[y] = make([]int, numConns[y])
+		connClosed[y] = make([]uint32, numConns[y])
+	}
+	for z := 0; z < numWorkers; z++ {
+		usingConn[r.getServer(z % NUM_STREAMS)][workerConns[z]]++
+	}
+	r.printAssignment(workerConns, numConns, workerNames)
+
+	var connections [][]net.Conn = make([][]net.Conn, NUM_SERVERS)
+	var senders [][]requestSender = make([][]requestSender, NUM_SERVERS)
+	var recvLocks [][]*sync.Mutex = make([][]*sync.Mutex, NUM_SERVERS)
+	var err error
+
+	/* The senders record what they write, so the recorder comes first. */
+	if r.RecordFile != "" {
+		r.rec, err = newRecorder(r.RecordFile, dbAddrs)
+		if err != nil {
+			return Result{Name: r.Name, Command: r.Command, Err: fmt.Errorf("could not record requests: %v", err)}
+		}
+	}
+
+	for s := range dbAddrs {
+		connections[s] = make([]net.Conn, numConns[s])
+		senders[s] = make([]requestSender, numConns[s])
+		recvLocks[s] = make([]*sync.Mutex, numConns[s])
+		for i := range connections[s] {
+			if usingConn[s][i] == 0 {
+				continue
+			}
+			connections[s][i], err = net.Dial("tcp", dbAddrs[s])
+			if err == nil {
+				r.printf("Created connection %v to %v\n", i, dbAddrs[s])
+				senders[s][i] = newRequestSender(r.SEND_MODE, connections[s][i], r.rec, ConnectionID{s, i}, ctx.Done())
+				recvLocks[s][i] = &sync.Mutex{}
+			} else {
+				closeAll(connections)
+				if r.rec != nil {
+					r.rec.close()
+				}
+				return Result{Name: r.Name, Command: r.Command, Err: fmt.Errorf("could not connect to database: %v", err)}
+			}
+		}
+	}
+	r.printf("Finished creating connections\n")
+
+	var sig chan ConnectionID = make(chan ConnectionID)
+	var workers []*worker
+
+	var done chan struct{} = make(chan struct{})
+
+	var memBefore runtime.MemStats
+	var overlapped func () bool = trackOverlap()
+	runtime.ReadMemStats(&memBefore)
+	var startTime int64 = time.Now().UnixNano()
+	r.startTime = startTime
+	/* Every worker has to exist before the first response can arrive. */
+	workers = make([]*worker, numWorkers)
+	for z := 0; z < numWorkers; z++ {
+		serverIndex = r.getServer(z % NUM_STREAMS)
+		connIndex = workerConns[z]
+		var w *worker = &worker{
+			stream: Stream{
+				UUID: uuids[z % NUM_STREAMS],
+				Worker: z,
+				Rand: rand.New(rand.NewSource(seedGen.Int63())),
+				Starts: perm[z],
+				Spans: spans[z],
+				PointWidths: pws[z],
+			},
+			sender: senders[serverIndex][connIndex],
+			connID: ConnectionID{serverIndex, connIndex},
+			cont: make(chan uint64, r.MAX_CONCURRENT_MESSAGES),
+			current: FIRST_TIME,
+		}
+		if r.GET_MESSAGE_TIMES {
+			w.history = make([]TransactionData, len(perm[z]))
+		}
+		if pws[z] != nil {
+			w.sendTimes = make([]int64, len(perm[z]))
+		}
+		/* Every worker takes as long to send its points as the whole
+		   run takes to send all of them. */
+		if r.POINTS_PER_SECOND > 0 && len(perm[z]) != 0 {
+			w.nanosBetweenMessages = int64(float64(totalPoints) * 1e9 / float64(r.POINTS_PER_SECOND) / float64(len(perm[z])))
+		}
+		w.load = r.workloads[z / NUM_STREAMS].NewWorker(w.stream)
+		workers[z] = w
+	}
+
+	for _, w := range workers {
+		go r.sendMessages(ctx, w, sig)
+	}
+
+	for serverIndex = 0; serverIndex < NUM_SERVERS; serverIndex++ {
+		for connIndex = 0; connIndex < numConns[serverIndex]; connIndex++ {
+			if usingConn[serverIndex][connIndex] == 0 {
+				continue
+			}
+			go r.validateResponses(ctx, connections[serverIndex][connIndex], ConnectionID{serverIndex, connIndex}, recvLocks[serverIndex][connIndex], workers, &connClosed[serverIndex][connIndex])
+		}
+	}
+
+	go func () {
+		var lastSent, lastReceived uint64
+		var ticker *time.Ticker = time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			r.health.sampleGoroutines()
+			var sent uint64 = atomic.LoadUint64(&r.points_sent)
+			var received uint64 = atomic.LoadUint64(&r.points_received)
+			r.printf("Sent %v, Received %v (total %v, %v)\n", sent - lastSent, received - lastReceived, sent, received)
+			lastSent, lastReceived = sent, received
+		}
+	}()
+
+	var response ConnectionID
+	var cancelled <-chan struct{} = ctx.Done()
+	for k := 0; k < numWorkers; {
+		select {
+		case response = <-sig:
+		case <-cancelled:
+			/* Close every connection, so that workers and validateResponses
+			   that are blocked on one return. The workers still report back. */
+			if err := r.getErr(); err != nil {
+				r.printf("Stopping: %v\n", err)
+			} else {
+				r.printf("Run cancelled.\n")
+			}
+			r.printf("The following are the start times of the messages that are currently being inserted/queried:\n")
+			for i, w := range workers {
+				fmt.Printf("%v: %v\n", workerNames[i], atomic.LoadInt64(&w.current))
+			}
+			for s := range connections {
+				for c := range connections[s] {
+					if usingConn[s][c] != 0 {
+						atomic.StoreUint32(&connClosed[s][c], 1)
+						connections[s][c].Close()
+					}
+				}
+			}
+			cancelled = nil
+			continue
+		}
+		k++
+		serverIndex = response.serverIndex
+		connIndex = response.connectionIndex
+		usingConn[serverIndex][connIndex]--
+		if usingConn[serverIndex][connIndex] == 0 {
+			senders[serverIndex][connIndex].close()
+			if atomic.LoadUint32(&connClosed[serverIndex][connIndex]) == 0 {
+				atomic.StoreUint32(&connClosed[serverIndex][connIndex], 1)
+				connections[serverIndex][connIndex].Close()
+				r.printf("Closed connection %v to server %v\n", connIndex, dbAddrs[serverIndex])
+			}
+		}
+	}
+
+	var deltaT int64 = time.Now().UnixNano() - startTime
+	var memAfter runtime.MemStats
+	runtime.ReadMemStats(&memAfter)
+	var othersRan bool = overlapped()
+
+	// I used to close unused connections here, but now I don't bother
+
+	close(done)
+	var verification_test_pass bool = (atomic.LoadUint32(&r.verificationFailed) == 0)
+	if ctx.Err() != nil {
+		verification_test_pass = false // not everything was checked
+	}
+
+	if !DELETE_POINTS {
+		r.printf("Sent %v, Received %v in total\n", atomic.LoadUint64(&r.points_sent), atomic.LoadUint64(&r.points_received))
+		var messages, writes uint64
+		for s := range senders {
+			for _, sender := range senders[s] {
+				if sender != nil {
+					var stats senderStats = sender.stats()
+					messages += stats.messages
+					writes += stats.writes
+				}
+			}
+		}
+		r.printf("Sent %v messages in %v writes (SEND_MODE=%v)\n", messages, writes, r.SEND_MODE)
+	}
+	if r.VERIFY_RESPONSES {
+		r.printf("%v points are verified to be correct\n", atomic.LoadUint64(&r.points_verified));
+		if verification_test_pass {
+			r.printf("All points were verified to be correct. Test PASSes.\n")
+		} else if ctx.Err() != nil && atomic.LoadUint32(&r.verificationFailed) == 0 {
+			r.printf("The run was stopped before all points were verified. Test FAILs.\n")
+		} else {
+			r.printf("Some points were found to be incorrect. Test FAILs.\n")
+		}
+	} else if ctx.Err() != nil {
+		r.printf("Stopped early\n")
+	} else {
+		r.printf("Finished\n")
+	}
+
+	var numResPoints uint64 = 0
+	var streamPoints []uint64 = make([]uint64, NUM_STREAMS)
+	if DELETE_POINTS {
+		numResPoints = uint64(r.TOTAL_RECORDS) * uint64(numWorkers)
+		for g := 0; g < NUM_STREAMS; g++ {
+			streamPoints[g] = uint64(r.TOTAL_RECORDS)
+		}
+	} else {
+		for z, w := range workers {
+			numResPoints += w.pointsSent
+			streamPoints[z % NUM_STREAMS] += w.pointsSent
+		}
+	}
+	r.printf("Total time: %d nanoseconds for %d points\n", deltaT, numResPoints)
+	r.printServerReport(streamPoints)
+	var average uint64 = 0
+	if numResPoints != 0 {
+		average = uint64(deltaT) / numResPoints
+	}
+	r.printf("Average: %d nanoseconds per point (floored to integer value)\n", average)
+	r.printf("%v\n", deltaT)
+	var pwStats []PointWidthStats
+	if r.QUERY_RANGES.MaxPW != 0 && !DELETE_POINTS {
+		pwStats = r.pointWidthStats()
+		r.printPointWidthReport(pwStats, time.Duration(deltaT))
+	}
+	var health HealthStats
+	if !DELETE_POINTS {
+		var receiveLoops int = 0
+		for s := range usingConn {
+			for c := range connections[s] {
+				if connections[s][c] != nil {
+					receiveLoops++
+				}
+			}
+		}
+		health = r.healthStats(numWorkers, receiveLoops, senders, &memBefore, &memAfter, othersRan, time.Duration(deltaT))
+		r.printHealthReport(health, time.Duration(deltaT))
+	}
+
+	var runErr error = r.getErr()
+	if r.rec != nil {
+		if err := r.rec.close(); err != nil && runErr == nil {
+			runErr = fmt.Errorf("could not record requests to %v: %v", r.RecordFile, err)
+		} else {
+			r.printf("Recorded the requests to %v\n", r.RecordFile)
+		}
+	}
+	if r.GET_MESSAGE_TIMES && r.StatsFile != "" {
+		if err := writeStats(r.StatsFile, workerNames, workers); err != nil && runErr == nil {
+			runErr = fmt.Errorf("could not write stats to %v: %v", r.StatsFile, err)
+		}
+	}
+
+	return Result{
+		Name: r.Name,
+		Command: r.Command,
+		Points: numResPoints,
+		Verified: atomic.LoadUint64(&r.points_verified),
+		Pass: verification_test_pass && runErr == nil,
+		Cancelled: parent.Err() != nil,
+		Duration: time.Duration(deltaT),
+		PointWidths: pwStats,
+		Health: health,
+		Err: runErr,
+	}
+}
+
+/* Writes the send and response time of every message, per worker, as JSON. */
+func writeStats(path string, workerNames []string, workers []*worker) error {
+	var transactionHistories [][]TransactionData = make([][]TransactionData, len(workers))
+	for z, w := range workers {
+		transactionHistories[z] = w.history
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	for q := range transactionHistories {
+		fmt.Fprintf(&buf, "\"%v\": [\n", workerNames[q])
+		terminator := ","
+		for r := range transactionHistories[q] {
+		    if (r == len(transactionHistories[q]) - 1) {
+		        terminator = ""
+		    }
+			fmt.Fprintf(&buf, "[%v,%v]%s\n", transactionHistories[q][r].sendTime, transactionHistories[q][r].respTime, terminator)
+		}
+		if q == len(transactionHistories) - 1 {
+			buf.WriteString("]\n")
+		} else {
+			buf.WriteString("],\n")
+		}
+	}
+	buf.WriteString("}\n")
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+/* Closes the connections that are open. */
+func closeAll(connections [][]net.Conn) {
+	for s := range connections {
+		for _, connection := range connections[s] {
+			if connection != nil {
+				connection.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package loadgen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* SEND_MODE selects how the workers that share a connection write to it:
+     batch  every connection has a writer goroutine; workers encode their
+            messages into buffers and queue them, and the writer copies
+            whatever is queued into one buffered write
+     mutex  every worker writes its own messages to the connection while
+            holding a lock, which means one small write per message (what
+            we used to do) */
+var SendModes []string = []string{"batch", "mutex"}
+
+/* A requestSender sends the requests of all the workers on one connection,
+   and records them, with the number of points in each, if the run is being
+   recorded. */
+type requestSender interface {
+	send(segment *capnp.Segment, points uint64) error
+	/* Waits until everything that was sent has been written. */
+	close() error
+	stats() senderStats
+}
+
+/* What a requestSender did; the times are in ns, summed over the workers. */
+type senderStats struct {
+	messages uint64
+	writes uint64 // to the connection
+	encode uint64 // serializing messages into buffers
+	lockWait uint64 // waiting for the lock or for room in the queue
+	lockHeld uint64 // holding the lock
+}
+
+/* Frames a message for the stream the way segment.WriteTo does, but without
+   allocating: fills in header and returns the data that follows it. Only
+   messages of one segment, which is what capnp.NewBuffer makes, are framed
+   here; ok is false for others, which WriteTo has to write. */
+func frameSegment(header *[8]byte, segment *capnp.Segment) (data []byte, ok bool) {
+	if other, _ := segment.Message.Lookup(1); other != nil {
+		return nil, false
+	}
+	first, _ := segment.Message.Lookup(0)
+	binary.LittleEndian.PutUint32(header[0:4], 0) // the number of segments less one
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(first.Data) / 8))
+	return first.Data, true
+}
+
+/* What send returns once cancelled is closed while it waits for room in the queue. */
+var errSendCancelled error = errors.New("sending was cancelled")
+
+/* rec may be nil; connID is what the requests are recorded with. Closing
+   cancelled stops sends that wait for room in the queue of a batch sender;
+   a send that waits for the connection returns once it is closed. */
+func newRequestSender(mode string, connection net.Conn, rec *recorder, connID ConnectionID, cancelled <-chan struct{}) requestSender {
+	if mode == "mutex" {
+		return &mutexSender{connection: connection, rec: rec, connID: connID}
+	}
+	var s *batchSender = &batchSender{
+		connection: connection,
+		rec: rec,
+		connID: connID,
+		cancelled: cancelled,
+		writer: bufio.NewWriterSize(connection, BATCH_BUFFER_SIZE),
+		queue: make(chan batchMessage, BATCH_QUEUE_LENGTH),
+		free: make(chan *bytes.Buffer, BATCH_QUEUE_LENGTH + BATCH_SPARE_BUFFERS),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < cap(s.free); i++ {
+		s.free <- &bytes.Buffer{}
+	}
+	go s.writeLoop()
+	return s
+}
+
+type mutexSender struct {
+	counts senderStats // lockWait is set atomically, the rest under the lock; first to be 64-bit aligned
+	connection net.Conn
+	rec *recorder
+	connID ConnectionID
+	lock sync.Mutex
+	header [8]byte // under the lock
+}
+
+func (s *mutexSender) send(segment *capnp.Segment, points uint64) error {
+	var start time.Time = time.Now()
+	s.lock.Lock()
+	var locked time.Time = time.Now()
+	atomic.AddUint64(&s.counts.lockWait, uint64(locked.Sub(start)))
+	var err error
+	if data, ok := frameSegment(&s.header, segment); ok {
+		if _, err = s.connection.Write(s.header[:]); err == nil {
+			_, err = s.connection.Write(data)
+		}
+	} else {
+		_, err = segment.WriteTo(s.connection)
+	}
+	if err == nil && s.rec != nil {
+		s.rec.record(s.connID, points, segment)
+	}
+	s.counts.messages++
+	s.counts.lockHeld += since(locked)
+	s.lock.Unlock()
+	return err
+}
+
+func (s *mutexSender) close() error {
+	return nil
+}
+
+func (s *mutexSender) stats() senderStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return senderStats{
+		messages: s.counts.messages,
+		writes: s.counts.messages,
+		lockWait: atomic.LoadUint64(&s.counts.lockWait),
+		lockHeld: s.counts.lockHeld,
+	}
+}
+
+/* The size of the buffer that queued messages are copied into before they are
+   written, and how many messages can be queued before the workers block. */
+const BATCH_BUFFER_SIZE = 1 << 20
+const BATCH_QUEUE_LENGTH = 256
+
+/* Every connection keeps the buffers that its messages are encoded into, so
+   that once they have grown to the size of a message, sending allocates
+   nothing. There is one for every place in the queue, and a few for the
+   workers that are encoding while the queue is full. */
+const BATCH_SPARE_BUFFERS = 16
+
+/* A queued message: its encoding, and the points in it for the recording. */
+type batchMessage struct {
+	buf *bytes.Buffer
+	points uint64
+}
+
+type batchSender struct {
+	counts senderStats // set atomically; first to be 64-bit aligned
+	connection net.Conn
+	rec *recorder
+	connID ConnectionID
+	cancelled <-chan struct{}
+	writer *bufio.Writer
+	queue chan batchMessage
+	free chan *bytes.Buffer // buffers that are not queued
+	done chan struct{}
+	closeOnce sync.Once
+
+	errLock sync.Mutex
+	err error
+}
+
+/* Encodes the segment, so the caller can reuse it right away, and queues it. */
+func (s *batchSender) send(segment *capnp.Segment, points uint64) error {
+	if err := s.getErr(); err != nil {
+		return err
+	}
+	var start time.Time = time.Now()
+	var buf *bytes.Buffer = s.getBuffer()
+	var header [8]byte
+	if data, ok := frameSegment(&header, segment); ok {
+		buf.Write(header[:])
+		buf.Write(data)
+	} else if _, err := segment.WriteTo(buf); err != nil {
+		s.putBuffer(buf)
+		return err
+	}
+	var encoded time.Time = time.Now()
+	atomic.AddUint64(&s.counts.encode, uint64(encoded.Sub(start)))
+	select {
+	case s.queue <- batchMessage{buf, points}:
+	case <-s.cancelled:
+		s.putBuffer(buf)
+		return errSendCancelled
+	}
+	atomic.AddUint64(&s.counts.lockWait, since(encoded))
+	return nil
+}
+
+/* Writes the queued messages, flushing whenever the queue runs empty so
+   that a lone message is not held back waiting for more. */
+func (s *batchSender) writeLoop() {
+	for message := range s.queue {
+		var buf *bytes.Buffer = message.buf
+		if s.getErr() == nil {
+			var before int = s.writer.Buffered()
+			if _, err := s.writer.Write(buf.Bytes()); err != nil {
+				s.setErr(err)
+			} else {
+				if before + buf.Len() > BATCH_BUFFER_SIZE {
+					atomic.AddUint64(&s.counts.writes, 1) // the buffer filled up and was written out
+				}
+				if s.rec != nil {
+					s.rec.recordFrame(s.connID, message.points, buf.Bytes())
+				}
+			}
+			atomic.AddUint64(&s.counts.messages, 1)
+		}
+		s.putBuffer(buf)
+		if len(s.queue) == 0 && s.writer.Buffered() != 0 && s.getErr() == nil {
+			if err := s.writer.Flush(); err != nil {
+				s.setErr(err)
+			}
+			atomic.AddUint64(&s.counts.writes, 1)
+		}
+	}
+	close(s.done)
+}
+
+/* Takes a free buffer. There are only none if more workers share the
+   connection than there are spare buffers; those get new ones, which are kept
+   as long as there is room for them. */
+func (s *batchSender) getBuffer() *bytes.Buffer {
+	var buf *bytes.Buffer
+	select {
+	case buf = <-s.free:
+		buf.Reset()
+	default:
+		buf = &bytes.Buffer{}
+	}
+	return buf
+}
+
+func (s *batchSender) putBuffer(buf *bytes.Buffer) {
+	select {
+	case s.free <- buf:
+	default:
+	}
+}
+
+func (s *batchSender) close() error {
+	s.closeOnce.Do(func () {
+		close(s.queue)
+	})
+	<-s.done
+	return s.getErr()
+}
+
+func (s *batchSender) stats() senderStats {
+	return senderStats{
+		messages: atomic.LoadUint64(&s.counts.messages),
+		writes: atomic.LoadUint64(&s.counts.writes),
+		encode: atomic.LoadUint64(&s.counts.encode),
+		lockWait: atomic.LoadUint64(&s.counts.lockWait),
+	}
+}
+
+func (s *batchSender) getErr() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+func (s *batchSender) setErr(err error) {
+	s.errLock.Lock()
+	s.err = err
+	s.errLock.Unlock()
+}
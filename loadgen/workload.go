@@ -0,0 +1,368 @@
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	cpint "github.com/SoftwareDefinedBuildings/btrdb/cpinterface"
+	capnp "github.com/glycerine/go-capnproto"
+)
+
+/* A Workload is a kind of request that the workers of a run send, such as
+   the inserts of insert mode or the queries of query mode. A run has one
+   worker per stream and workload; set Config.Workloads to plug in a new kind
+   of request or an access pattern of your own. */
+type Workload interface {
+	/* A short name, such as "insert". It labels the workers when a run has
+	   more than one workload. */
+	Name() string
+
+	/* Returns the state of one worker. Next and Close are only called by the
+	   goroutine that sends the messages of the worker, and Verify only by the
+	   goroutine that reads the responses from its connection, so a
+	   WorkloadWorker needs no locking as long as the two halves do not share
+	   anything. */
+	NewWorker(stream Stream) WorkloadWorker
+}
+
+/* What a worker works on. */
+type Stream struct {
+	UUID []byte
+	Worker int // index of the worker in the run
+	Rand *rand.Rand // seeded from RAND_SEED, the same for the same worker in every run
+	Starts []int64 // the start time of every message, in the order in which they are sent
+	Spans []int64 // if set, the ns that each message covers; otherwise NANOS_BETWEEN_POINTS * POINTS_PER_MESSAGE
+	PointWidths []uint8 // if set, the point width of each statistical query; otherwise STATISTICAL_PW
+}
+
+type WorkloadWorker interface {
+	/* Builds message j of the worker, which must carry echoTag, and returns
+	   it together with the number of points (or statistical records) that its
+	   response will hold. The segment may be reused once the message is sent. */
+	Next(j uint64, echoTag uint64) (*capnp.Segment, uint64)
+
+	/* Checks a response to the messages of the worker, in the order in which
+	   they arrive, when the run verifies responses. Returns the number of
+	   points that were found to be correct, and false if anything was wrong
+	   (after printing what). */
+	Verify(resp cpint.Response) (uint64, bool)
+
+	/* Called once the worker has sent its last message. Verify may still be
+	   called after it. */
+	Close()
+}
+
+type insertWorkload struct {
+	r *Runner
+}
+
+func (w insertWorkload) Name() string {
+	return "insert"
+}
+
+func (w insertWorkload) NewWorker(stream Stream) WorkloadWorker {
+	// I used to get from the pool and put it back every iteration. Now I just get it once and keep it.
+	var mp InsertMessagePart = w.r.insertPool.Get().(InsertMessagePart)
+	mp.insert.SetUuid(stream.UUID)
+	return &insertWorker{r: w.r, stream: stream, mp: mp}
+}
+
+type insertWorker struct {
+	r *Runner
+	stream Stream
+	mp InsertMessagePart
+}
+
+func (w *insertWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	var r *Runner = w.r
+	var currTime int64 = w.stream.Starts[j]
+	var randGen *rand.Rand = w.stream.Rand
+
+	w.mp.request.SetEchoTag(echoTag)
+
+	for _, record := range w.mp.records {
+		if r.DETERMINISTIC_KV {
+			record.SetTime(currTime)
+		} else {
+			record.SetTime(currTime + int64(randGen.Float64() * float64(r.MAX_TIME_RANDOM_OFFSET)))
+		}
+		record.SetValue(r.get_time_value(currTime, randGen))
+		currTime += r.NANOS_BETWEEN_POINTS
+	}
+	return w.mp.segment, uint64(r.POINTS_PER_MESSAGE)
+}
+
+/* The response to an insert holds nothing to check. */
+func (w *insertWorker) Verify(resp cpint.Response) (uint64, bool) {
+	return 0, true
+}
+
+func (w *insertWorker) Close() {
+	w.r.insertPool.Put(w.mp)
+}
+
+type standQueryWorkload struct {
+	r *Runner
+}
+
+func (w standQueryWorkload) Name() string {
+	return "query"
+}
+
+func (w standQueryWorkload) NewWorker(stream Stream) WorkloadWorker {
+	var mp QueryMessagePart = w.r.standQueryPool.Get().(QueryMessagePart)
+	mp.query.SetUuid(stream.UUID)
+	return &standQueryWorker{r: w.r, stream: stream, mp: mp, currTime: w.r.FIRST_TIME}
+}
+
+type standQueryWorker struct {
+	r *Runner
+	stream Stream
+	mp QueryMessagePart
+
+	/* Used by Verify: the time of the next point we expect, and the number
+	   of points in the responses to the current message so far. */
+	currTime int64
+	received uint64
+}
+
+func (w *standQueryWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	var currTime int64 = w.stream.Starts[j]
+	w.mp.request.SetEchoTag(echoTag)
+	w.mp.query.SetStartTime(currTime)
+	w.mp.query.SetEndTime(currTime + w.r.messageSpan(w.stream, j))
+	return w.mp.segment, uint64(w.r.messagePoints(w.stream, j))
+}
+
+func (w *standQueryWorker) Verify(resp cpint.Response) (uint64, bool) {
+	var r *Runner = w.r
+	var randGen *rand.Rand = w.stream.Rand
+	var pass bool = true
+	var verified uint64 = 0
+	records := resp.Records().Values()
+	var num_records uint64 = uint64(records.Len())
+	var received float64 = 0
+	var recTime int64 = 0
+	var expTime int64
+	var expected float64 = 0
+	_, j := r.splitEchoTag(resp.EchoTag())
+	if r.DETERMINISTIC_KV && w.received == 0 {
+		/* The points do not depend on what came before, so the messages may
+		   come in any order (see PERM_SEED). */
+		w.currTime = w.stream.Starts[j]
+	}
+	if resp.Final() {
+		var expectedPoints uint64 = uint64(r.messagePoints(w.stream, j))
+		if num_records + w.received != expectedPoints {
+			fmt.Printf("Expected %v points in query response, but got %v points instead.\n", expectedPoints, num_records)
+			pass = false
+		}
+		w.received = 0
+	} else {
+		w.received += num_records
+	}
+	for m := 0; uint64(m) < num_records; m++ {
+		received = records.At(m).Value()
+		recTime = records.At(m).Time()
+		expTime = r.getExpTime(w.currTime, randGen)
+		expected = r.get_time_value(recTime, randGen)
+		if expTime == recTime && received == expected {
+			verified++
+			if r.PRINT_ALL {
+				fmt.Printf("Received expected point (%v, %v)\n", recTime, received)
+			}
+		} else {
+			fmt.Printf("Expected (%v, %v), got (%v, %v)\n", expTime, expected, recTime, received)
+			pass = false
+		}
+		w.currTime = w.currTime + r.NANOS_BETWEEN_POINTS
+	}
+	return verified, pass
+}
+
+func (w *standQueryWorker) Close() {
+	w.r.standQueryPool.Put(w.mp)
+}
+
+type statQueryWorkload struct {
+	r *Runner
+}
+
+func (w statQueryWorkload) Name() string {
+	return "query"
+}
+
+func (w statQueryWorkload) NewWorker(stream Stream) WorkloadWorker {
+	var mp StatQueryMessagePart = w.r.statQueryPool.Get().(StatQueryMessagePart)
+	mp.query.SetUuid(stream.UUID)
+	var worker *statQueryWorker = &statQueryWorker{r: w.r, stream: stream, mp: mp, currTime: w.r.FIRST_TIME}
+	if w.r.VERIFY_RESPONSES {
+		worker.expTime = w.r.getExpTime(worker.currTime, stream.Rand)
+	}
+	return worker
+}
+
+type statQueryWorker struct {
+	r *Runner
+	stream Stream
+	mp StatQueryMessagePart
+
+	/* Used by Verify, like in standQueryWorker. expTime is the (perturbed)
+	   time of the point at currTime. */
+	currTime int64
+	expTime int64
+	received uint64
+}
+
+func (w *statQueryWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	var currTime int64 = w.stream.Starts[j]
+	var span int64 = w.r.messageSpan(w.stream, j)
+	var pw uint8 = w.r.messagePW(w.stream, j)
+	w.mp.request.SetEchoTag(echoTag)
+	w.mp.query.SetStartTime(currTime)
+	w.mp.query.SetEndTime(currTime + span)
+	w.mp.query.SetPointWidth(pw)
+	return w.mp.segment, uint64(span >> pw)
+}
+
+func (w *statQueryWorker) Verify(resp cpint.Response) (uint64, bool) {
+	var r *Runner = w.r
+	var randGen *rand.Rand = w.stream.Rand
+	var pass bool = true
+	var verified uint64 = 0
+	records := resp.StatisticalRecords().Values()
+	var num_records uint64 = uint64(records.Len())
+	var total_count uint64 = 0
+	var expected float64
+	var expMin float64
+	var expMean float64
+	var expMax float64
+	var expRecTime int64
+	var expectedEnd int64
+	var expRecCount uint64
+	_, j := r.splitEchoTag(resp.EchoTag())
+	if r.DETERMINISTIC_KV && w.received == 0 {
+		w.currTime = w.stream.Starts[j]
+		w.expTime = w.currTime
+	}
+	var expTime int64 = w.expTime // we need this early since the pertubation may push it into a different interval
+	for m := 0; uint64(m) < num_records; m++ {
+		expRecTime = expTime & r.statisticalBitmaskUpper
+		expectedEnd = expRecTime + (1 << uint(r.pw))
+		expRecCount = 0
+		expMin = math.Inf(1)
+		expMean = 0
+		expMax = math.Inf(-1)
+
+		for expTime < expectedEnd {
+			expected = r.get_time_value(expTime, randGen)
+			expMin = math.Min(expected, expMin)
+			expMean += expected
+			expMax = math.Max(expected, expMax)
+			expRecCount++
+			w.currTime = w.currTime + r.NANOS_BETWEEN_POINTS
+			expTime = r.getExpTime(w.currTime, randGen)
+		}
+		expMean /= float64(expRecCount)
+		record := records.At(m)
+		if expRecTime == record.Time() && floatEquals(expMin, record.Min()) && floatEquals(expMean, record.Mean()) && floatEquals(expMax, record.Max()) && expRecCount == record.Count() {
+			verified += expRecCount
+			if r.PRINT_ALL {
+				fmt.Printf("Received record (time=%v, min=%v, mean=%v, max=%v, count=%v)\n", record.Time(), record.Min(), record.Mean(), record.Max(), record.Count())
+			}
+		} else {
+			fmt.Printf("Expected (time=%v, min=%v, mean=%v, max=%v, count=%v), got (time=%v, min=%v, mean=%v, max=%v, count=%v)\n", expRecTime, expMin, expMean, expMax, expRecCount, record.Time(), record.Min(), record.Mean(), record.Max(), record.Count())
+			pass = false
+		}
+		total_count += record.Count()
+	}
+	if resp.Final() {
+		var expectedPoints uint64 = uint64(r.messagePoints(w.stream, j))
+		if total_count + w.received != expectedPoints {
+			fmt.Printf("Expected %v points in query response, but got %v points instead.\n", expectedPoints, total_count)
+			pass = false
+		}
+		w.received = 0
+	} else {
+		w.received += total_count
+	}
+	// We still aren't done. We created an extra random number when we found that expTime is out of range, and we need that same expTime next time we receive something (if we generate it again, we will get the wrong result).
+	w.expTime = expTime
+	return verified, pass
+}
+
+func (w *statQueryWorker) Close() {
+	w.r.statQueryPool.Put(w.mp)
+}
+
+/* Delete and flush send one message per stream, whose response holds nothing
+   to check but its status. */
+type deleteWorkload struct {
+	r *Runner
+}
+
+func (w deleteWorkload) Name() string {
+	return "delete"
+}
+
+func (w deleteWorkload) NewWorker(stream Stream) WorkloadWorker {
+	var mp DeleteMessagePart = deletePool.Get().(DeleteMessagePart)
+	mp.query.SetUuid(stream.UUID)
+	mp.request.SetDeleteValues(*mp.query)
+	return &deleteWorker{r: w.r, stream: stream, mp: mp}
+}
+
+type deleteWorker struct {
+	r *Runner
+	stream Stream
+	mp DeleteMessagePart
+}
+
+func (w *deleteWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	start, end := w.r.deleteRange(w.stream.Worker % w.r.NUM_STREAMS)
+	w.mp.request.SetEchoTag(echoTag)
+	w.mp.query.SetStartTime(start)
+	w.mp.query.SetEndTime(end)
+	return w.mp.segment, uint64(w.r.TOTAL_RECORDS)
+}
+
+func (w *deleteWorker) Verify(resp cpint.Response) (uint64, bool) {
+	return 0, true
+}
+
+func (w *deleteWorker) Close() {
+	deletePool.Put(w.mp)
+}
+
+type flushWorkload struct {
+	r *Runner
+}
+
+func (w flushWorkload) Name() string {
+	return "flush"
+}
+
+func (w flushWorkload) NewWorker(stream Stream) WorkloadWorker {
+	var mp FlushMessagePart = flushPool.Get().(FlushMessagePart)
+	mp.query.SetUuid(stream.UUID)
+	mp.request.SetFlush(*mp.query)
+	return &flushWorker{mp: mp}
+}
+
+type flushWorker struct {
+	mp FlushMessagePart
+}
+
+func (w *flushWorker) Next(j uint64, echoTag uint64) (*capnp.Segment, uint64) {
+	w.mp.request.SetEchoTag(echoTag)
+	return w.mp.segment, 0
+}
+
+func (w *flushWorker) Verify(resp cpint.Response) (uint64, bool) {
+	return 0, true
+}
+
+func (w *flushWorker) Close() {
+	flushPool.Put(w.mp)
+}
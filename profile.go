@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+/* The profiles of the generator itself, to tell whether it (building capnp
+   segments, waiting for the lock of a connection, ...) is the bottleneck rather
+   than BTrDB. The CPU profile and the execution trace cover the whole run; the
+   heap, allocs, block and mutex profiles are written when it ends. With -pprof,
+   net/http/pprof serves all of them while the run goes on, e.g.
+     go tool pprof http://localhost:6060/debug/pprof/mutex */
+type profileOptions struct {
+	cpu string
+	heap string
+	allocs string
+	block string
+	mutex string
+	trace string
+	httpAddr string
+}
+
+/* Starts the profiles that opts ask for, and returns a function that stops
+   them and writes them out. The function must be called before the program
+   exits, also when it exits with os.Exit. */
+func startProfiles(opts profileOptions) (func(), error) {
+	var stops []func()
+	var stop func() = func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+		stops = nil
+	}
+
+	/* Blocking and contention are only recorded while asked for, since
+	   recording every event slows the generator down. */
+	if opts.block != "" || opts.httpAddr != "" {
+		runtime.SetBlockProfileRate(1)
+	}
+	if opts.mutex != "" || opts.httpAddr != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+
+	if opts.httpAddr != "" {
+		listener, err := net.Listen("tcp", opts.httpAddr)
+		if err != nil {
+			return stop, fmt.Errorf("could not serve the profiles: %v", err)
+		}
+		fmt.Printf("Serving the profiles at http://%v/debug/pprof/\n", listener.Addr())
+		go http.Serve(listener, nil)
+		stops = append(stops, func() { listener.Close() })
+	}
+	if opts.cpu != "" {
+		f, err := os.Create(opts.cpu)
+		if err != nil {
+			stop()
+			return stop, err
+		}
+		if err = pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			os.Remove(opts.cpu)
+			stop()
+			return stop, fmt.Errorf("could not start the CPU profile: %v", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if opts.trace != "" {
+		f, err := os.Create(opts.trace)
+		if err == nil {
+			if err = trace.Start(f); err != nil {
+				f.Close()
+				os.Remove(opts.trace)
+			}
+		}
+		if err != nil {
+			stop()
+			return stop, fmt.Errorf("could not start the execution trace: %v", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	for _, p := range []struct {
+		name string
+		file string
+	}{{"heap", opts.heap}, {"allocs", opts.allocs}, {"block", opts.block}, {"mutex", opts.mutex}} {
+		if p.file == "" {
+			continue
+		}
+		/* Create the file now, so that a bad name is reported before the run. */
+		f, err := os.Create(p.file)
+		if err != nil {
+			stop()
+			return stop, err
+		}
+		var name string = p.name
+		stops = append(stops, func() {
+			if name == "heap" {
+				runtime.GC() // so the profile shows what is still in use
+			}
+			if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+				fmt.Printf("Could not write the %v profile: %v\n", name, err)
+			}
+			f.Close()
+		})
+	}
+	return stop, nil
+}
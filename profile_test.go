@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"testing"
+)
+
+/* A profile that cannot be started is reported, and leaves no file behind. */
+func TestStartProfiles(t *testing.T) {
+	var dir string = t.TempDir()
+	if _, err := startProfiles(profileOptions{cpu: filepath.Join(dir, "missing", "cpu.prof")}); err == nil {
+		t.Errorf("started a CPU profile in a directory that does not exist")
+	}
+
+	running, err := os.Create(filepath.Join(dir, "running.prof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pprof.StartCPUProfile(running); err != nil {
+		t.Fatal(err)
+	}
+	var path string = filepath.Join(dir, "cpu.prof")
+	_, err = startProfiles(profileOptions{cpu: path, heap: filepath.Join(dir, "heap.prof")})
+	pprof.StopCPUProfile()
+	running.Close()
+	if err == nil {
+		t.Errorf("started a second CPU profile")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the CPU profile that could not be started left %v behind", path)
+	}
+
+	stop, err := startProfiles(profileOptions{cpu: path, heap: filepath.Join(dir, "heap.prof")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	for _, name := range []string{"cpu.prof", "heap.prof"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Size() == 0 {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+}
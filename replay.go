@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lilvinz/quasarloadgenerator/loadgen"
+)
+
+/* The "replay" command sends the requests that a run recorded with -record
+   again, so that a load can be reproduced exactly, e.g. against another
+   build of BTrDB. */
+func replayCommand(args []string) {
+	var fs *flag.FlagSet = flag.NewFlagSet("replay", flag.ExitOnError)
+	var speed *float64 = fs.Float64("speed", 1, "how much faster than recorded to send the requests; 0 sends them as fast as possible")
+	var dbAddrs *string = fs.String("db-addrs", "", "comma separated servers to send to instead of the recorded ones: one for each of them, or one for all")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] <recording>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Sends the requests of a recording made with -record again, on the same\nconnections and at the same times, and waits for every response.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var cfg loadgen.ReplayConfig = loadgen.ReplayConfig{File: fs.Arg(0), Speed: *speed}
+	if *dbAddrs != "" {
+		cfg.DB_ADDRS = strings.Split(*dbAddrs, ",")
+	}
+	var result loadgen.Result = loadgen.Replay(interruptContext(), cfg)
+	if result.Err != nil {
+		fmt.Println(result.Err)
+	}
+	if !result.Pass {
+		os.Exit(1)
+	}
+}
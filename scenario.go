@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lilvinz/quasarloadgenerator/loadgen"
+)
+
+/* A scenario file is a TOML file that describes a benchmark as a sequence of
+   phases, e.g.
+
+	config = "loadConfig.ini"   # relative to the scenario file
+	TOTAL_RECORDS = 1048576      # settings here apply to every phase
+
+	[[phase]]
+	name = "load"
+	command = "insert"
+	POINTS_PER_SECOND = 1000000
+
+	[[phase]]
+	name = "flush"
+	command = "flush"
+
+	[[phase]]
+	name = "pw30"
+	command = "query"
+	STATISTICAL_PW = 30
+	parallel = true              # runs at the same time as the phase before it
+
+   Settings are written with the same keys as in the configuration file; UUID
+   and DB_ADDR may also be given as arrays that replace the whole list. */
+
+type scenarioPhase struct {
+	name string
+	command string
+	parallel bool
+	printAll bool
+	opts runOptions
+}
+
+/* Copies the settings in a table of the scenario file into opts. */
+func addScenarioSettings(table map[string]interface{}, opts *runOptions, where string) bool {
+	var isErr bool = false
+	for key, value := range table {
+		if strings.ToUpper(key) != key {
+			continue // lower case keys are handled by the caller
+		}
+		if list, ok := value.([]interface{}); ok {
+			var values []string
+			for _, elem := range list {
+				values = append(values, fmt.Sprint(elem))
+			}
+			opts.lists[key] = values
+			continue
+		}
+		if _, ok := value.(map[string]interface{}); ok {
+			fmt.Printf("%v: %v must be a single value\n", where, key)
+			isErr = true
+			continue
+		}
+		opts.overrides[key] = fmt.Sprint(value)
+	}
+	return isErr
+}
+
+/* Layers the overrides in over on top of those in base. */
+func mergeOptions(base runOptions, over runOptions) runOptions {
+	var merged runOptions = base
+	merged.overrides = make(map[string]string)
+	merged.lists = make(map[string][]string)
+	for _, o := range []runOptions{base, over} {
+		for key, value := range o.overrides {
+			merged.overrides[key] = value
+		}
+		for key, values := range o.lists {
+			merged.lists[key] = values
+		}
+	}
+	return merged
+}
+
+/* Reads a scenario file. The command line options in cli are applied on top
+   of every phase; configSet tells whether -config was given explicitly. */
+func readScenario(path string, cli runOptions, configSet bool) ([]scenarioPhase, bool) {
+	var contents map[string]interface{}
+	if _, err := toml.DecodeFile(path, &contents); err != nil {
+		fmt.Printf("Could not read scenario %v: %v\n", path, err)
+		return nil, true
+	}
+
+	var isErr bool = false
+	var common runOptions = runOptions{overrides: make(map[string]string), lists: make(map[string][]string)}
+	common.configPath = cli.configPath
+	if config, ok := contents["config"].(string); ok && !configSet {
+		if !filepath.IsAbs(config) {
+			config = filepath.Join(filepath.Dir(path), config)
+		}
+		common.configPath = config
+	}
+	isErr = addScenarioSettings(contents, &common, path) || isErr
+
+	tables, ok := contents["phase"].([]map[string]interface{})
+	if !ok || len(tables) == 0 {
+		fmt.Printf("%v: no [[phase]] tables\n", path)
+		return nil, true
+	}
+
+	var phases []scenarioPhase
+	for i, table := range tables {
+		var phase scenarioPhase = scenarioPhase{name: fmt.Sprintf("phase%v", i + 1)}
+		var where string = fmt.Sprintf("%v: phase %v", path, i + 1)
+		var own runOptions = runOptions{overrides: make(map[string]string), lists: make(map[string][]string)}
+		own.configPath = common.configPath
+		for key, value := range table {
+			var str string = fmt.Sprint(value)
+			switch key {
+			case "name":
+				phase.name = str
+			case "command":
+				phase.command = str
+			case "parallel":
+				phase.parallel = (str == "true")
+			case "print_all":
+				phase.printAll = (str == "true")
+			case "config":
+				if !configSet {
+					own.configPath = str
+					if !filepath.IsAbs(str) {
+						own.configPath = filepath.Join(filepath.Dir(path), str)
+					}
+				}
+			default:
+				if strings.ToUpper(key) != key {
+					fmt.Printf("%v: unknown key %v\n", where, key)
+					isErr = true
+				}
+			}
+		}
+		isErr = addScenarioSettings(table, &own, where) || isErr
+		switch phase.command {
+		case "insert", "query", "verify", "delete", "flush", "mixed":
+		default:
+			fmt.Printf("%v: unknown command %q\n", where, phase.command)
+			isErr = true
+		}
+		if i == 0 && phase.parallel {
+			fmt.Printf("%v: the first phase cannot run in parallel with the phase before it\n", where)
+			isErr = true
+		}
+		phase.opts = mergeOptions(mergeOptions(common, own), cli)
+		phase.opts.configPath = own.configPath // already the -config of the command line if it was given
+		phases = append(phases, phase)
+	}
+	return phases, isErr
+}
+
+/* Prints a line for each of the results of the phases of a scenario or the
+   groups of a run; kind is what they are. */
+func printReport(kind string, results []loadgen.Result) {
+	fmt.Println()
+	fmt.Printf("%-16s %-8s %14s %12s %14s %8s\n", kind, "Command", "Points", "Time (s)", "Points/s", "Result")
+	for _, result := range results {
+		var seconds float64 = result.Duration.Seconds()
+		var rate float64 = 0
+		if seconds > 0 {
+			rate = float64(result.Points) / seconds
+		}
+		var outcome string = "done"
+		if result.Cancelled {
+			outcome = "stopped"
+		} else if result.Err != nil {
+			outcome = "error"
+		} else if result.Command == "" {
+			outcome = "skipped"
+		} else if result.Command == "verify" {
+			if result.Pass {
+				outcome = "PASS"
+			} else {
+				outcome = "FAIL"
+			}
+		}
+		fmt.Printf("%-16s %-8s %14d %12.3f %14.0f %8s\n", result.Name, result.Command, result.Points, seconds, rate, outcome)
+	}
+}
+
+/* The "scenario" command runs the phases of a scenario file in order. Phases
+   marked parallel run at the same time as the phase before them. On ^C the
+   running phases stop, the rest are skipped, and the report is still printed. */
+func scenarioCommand(args []string) {
+	var cli runOptions
+	var fs = newRunFlags("scenario", &cli)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s scenario [flags] <scenario.toml>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Runs the phases of a scenario file. The flags apply to every phase.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var configSet bool = false
+	fs.Visit(func (f *flag.Flag) {
+		if f.Name == "config" {
+			configSet = true
+		}
+	})
+
+	phases, isErr := readScenario(fs.Arg(0), cli, configSet)
+	if isErr {
+		os.Exit(1)
+	}
+
+	/* Check every phase before running any of them. */
+	var configs []map[string]interface{} = make([]map[string]interface{}, len(phases))
+	var invalid bool = false
+	for i := range phases {
+		configs[i], isErr = loadConfig(&phases[i].opts)
+		if isErr {
+			os.Exit(1)
+		}
+		if countList(configs[i], "GROUP") != 0 {
+			fmt.Printf("phase %v: stream groups are not supported in scenarios; use a parallel phase for each group instead\n", phases[i].name)
+			invalid = true
+			continue
+		}
+		var problems []configProblem = validateConfig(configs[i], phases[i].command)
+		if len(problems) != 0 {
+			printProblems(fmt.Sprintf("phase %v (%v)", phases[i].name, phases[i].opts.configPath), problems)
+			invalid = true
+		}
+	}
+	if invalid {
+		os.Exit(1)
+	}
+
+	stopProfiles, err := startProfiles(cli.profiles)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer stopProfiles()
+
+	var ctx context.Context = interruptContext()
+	var results []loadgen.Result = make([]loadgen.Result, len(phases))
+	for i := range phases {
+		results[i].Name = phases[i].name // phases that are never started show as skipped
+	}
+	for start := 0; start < len(phases) && ctx.Err() == nil; {
+		var end int = start + 1
+		for end < len(phases) && phases[end].parallel {
+			end++
+		}
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			cfg, err := buildRunConfig(phases[i].name, phases[i].command, configs[i], phases[i].printAll, WRITE_UUID_FILE)
+			var r *loadgen.Runner
+			if err == nil {
+				cfg.StatsFile = phases[i].name + "-stats.json"
+				if cli.recordFile != "" { // every phase gets a recording of its own
+					cfg.RecordFile = filepath.Join(filepath.Dir(cli.recordFile), phases[i].name + "-" + filepath.Base(cli.recordFile))
+				}
+				r, err = loadgen.NewRunner(cfg)
+			}
+			if err != nil {
+				fmt.Printf("[%v] %v\n", phases[i].name, err)
+				results[i] = loadgen.Result{Name: phases[i].name, Command: phases[i].command, Err: err}
+				continue
+			}
+			wg.Add(1)
+			go func (i int) {
+				results[i] = r.Run(ctx)
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		start = end
+	}
+
+	printReport("Phase", results)
+	for _, result := range results {
+		if !result.Pass || result.Command == "" {
+			stopProfiles()
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/* Every phase gets the settings of the scenario, then its own, then those of
+   the command line, and a config relative to the scenario file. */
+func TestReadScenario(t *testing.T) {
+	var dir string = t.TempDir()
+	var path string = writeFile(t, dir, "bench.toml", `
+config = "base.ini"
+TOTAL_RECORDS = 1024
+POINTS_PER_MESSAGE = 64
+UUID = ["9f67541c-95ee-11e4-a7ac-0026b6df9cf2", "221b154e-95de-11e4-bf98-0026b6df9cf2"]
+
+[[phase]]
+command = "insert"
+POINTS_PER_SECOND = 1000
+
+[[phase]]
+name = "pw30"
+command = "query"
+config = "/etc/other.ini"
+STATISTICAL_PW = 30
+TOTAL_RECORDS = 2048
+UUID = ["9f67541c-95ee-11e4-a7ac-0026b6df9cf3"]
+parallel = true
+
+[[phase]]
+name = "check"
+command = "verify"
+print_all = true
+`)
+	var cli runOptions
+	newRunFlags("scenario", &cli).Parse([]string{"-points-per-message", "128", "-db-addr", "cli:4410"})
+	phases, isErr := readScenario(path, cli, false)
+	if isErr || len(phases) != 3 {
+		t.Fatalf("read %v phases", len(phases))
+	}
+	for i, want := range []struct {
+		name string
+		command string
+		parallel bool
+		printAll bool
+		configPath string
+		overrides map[string]string
+		lists map[string][]string
+	}{
+		{"phase1", "insert", false, false, filepath.Join(dir, "base.ini"),
+			map[string]string{"TOTAL_RECORDS": "1024", "POINTS_PER_MESSAGE": "128", "POINTS_PER_SECOND": "1000"},
+			map[string][]string{"UUID": {"9f67541c-95ee-11e4-a7ac-0026b6df9cf2", "221b154e-95de-11e4-bf98-0026b6df9cf2"}, "DB_ADDR": {"cli:4410"}}},
+		{"pw30", "query", true, false, "/etc/other.ini",
+			map[string]string{"TOTAL_RECORDS": "2048", "POINTS_PER_MESSAGE": "128", "STATISTICAL_PW": "30"},
+			map[string][]string{"UUID": {"9f67541c-95ee-11e4-a7ac-0026b6df9cf3"}, "DB_ADDR": {"cli:4410"}}},
+		{"check", "verify", false, true, filepath.Join(dir, "base.ini"),
+			map[string]string{"TOTAL_RECORDS": "1024", "POINTS_PER_MESSAGE": "128"},
+			map[string][]string{"UUID": {"9f67541c-95ee-11e4-a7ac-0026b6df9cf2", "221b154e-95de-11e4-bf98-0026b6df9cf2"}, "DB_ADDR": {"cli:4410"}}},
+	} {
+		var p scenarioPhase = phases[i]
+		if p.name != want.name || p.command != want.command || p.parallel != want.parallel || p.printAll != want.printAll || p.opts.configPath != want.configPath {
+			t.Errorf("phase %v: %v %v parallel=%v print_all=%v config %v, want %v %v parallel=%v print_all=%v config %v", i + 1,
+				p.name, p.command, p.parallel, p.printAll, p.opts.configPath,
+				want.name, want.command, want.parallel, want.printAll, want.configPath)
+		}
+		if !reflect.DeepEqual(p.opts.overrides, want.overrides) || !reflect.DeepEqual(p.opts.lists, want.lists) {
+			t.Errorf("phase %v: overrides %v %v, want %v %v", i + 1, p.opts.overrides, p.opts.lists, want.overrides, want.lists)
+		}
+	}
+
+	/* -config on the command line wins over the scenario's. */
+	if phases, _ = readScenario(path, cli, true); phases[0].opts.configPath != cli.configPath || phases[1].opts.configPath != cli.configPath {
+		t.Errorf("phases use %v and %v instead of -config %v", phases[0].opts.configPath, phases[1].opts.configPath, cli.configPath)
+	}
+
+	for _, test := range []struct {
+		name string
+		contents string
+	}{
+		{"no phases", "TOTAL_RECORDS = 1024\n"},
+		{"unknown command", "[[phase]]\ncommand = \"upsert\"\n"},
+		{"no command", "[[phase]]\nname = \"load\"\n"},
+		{"unknown key", "[[phase]]\ncommand = \"insert\"\nrepeat = 3\n"},
+		{"first parallel", "[[phase]]\ncommand = \"insert\"\nparallel = true\n"},
+		{"table setting", "[[phase]]\ncommand = \"insert\"\n[phase.TIME_PATTERN]\ngaps = 1\n"},
+		{"not toml", "[[phase]\n"},
+	} {
+		if _, isErr := readScenario(writeFile(t, dir, "bad.toml", test.contents), cli, false); !isErr {
+			t.Errorf("%v: read without an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lilvinz/quasarloadgenerator/fakedb"
+)
+
+/* The "serve-fake" command runs an in-memory BTrDB server, so that the other
+   commands can be tried out (or run in CI) without a database. */
+func serveFakeCommand(args []string) {
+	var fs *flag.FlagSet = flag.NewFlagSet("serve-fake", flag.ExitOnError)
+	var addr *string = fs.String("addr", "localhost:4410", "address to listen on")
+	var chunkSize *int = fs.Int("chunk-size", 0, "split query results into responses of at most this many records (0: no limit)")
+	var replaceDuplicates *bool = fs.Bool("replace-duplicates", false, "replace a point with one inserted at the same time, instead of keeping both like BTrDB")
+	var faults fakedb.Faults
+	fs.DurationVar(&faults.Delay, "delay", 0, "wait this long before answering each request")
+	fs.IntVar(&faults.DropAfter, "drop-after", 0, "close each connection after this many responses")
+	fs.IntVar(&faults.WrongEchoTagEvery, "wrong-echo-tag-every", 0, "send every n-th response on a connection with a wrong echo tag")
+	fs.IntVar(&faults.ErrorEvery, "error-every", 0, "answer every n-th response on a connection with an error status")
+	fs.IntVar(&faults.CorruptEvery, "corrupt-every", 0, "change a value in every n-th response on a connection")
+	fs.BoolVar(&faults.Reorder, "reorder", false, "answer requests out of order")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve-fake [flags]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Runs a BTrDB server that keeps everything in memory, until ^C. The fault\nflags make it misbehave, to see how the generator copes.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	srv, err := fakedb.Listen(*addr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	srv.ChunkSize = *chunkSize
+	srv.ReplaceDuplicates = *replaceDuplicates
+	srv.SetFaults(faults)
+	fmt.Printf("Fake BTrDB listening on %v\n", srv.Addr())
+
+	<-interruptContext().Done()
+	streams, points := srv.Size()
+	srv.Close()
+	fmt.Printf("Held %v points in %v streams\n", points, streams)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+/* UUID_MODE selects where the UUIDs of the streams come from:
+     list    UUID1 ... UUID<NUM_STREAMS> in the configuration
+     name    name based (version 5) UUIDs of UUID_PREFIX followed by the stream number,
+             so the same prefix always gives the same streams
+     random  random UUIDs, written to UUID_FILE the first time and read from it afterwards
+     file    the first NUM_STREAMS UUIDs in UUID_FILE, one per line */
+var uuidModes []string = []string{"list", "name", "random", "file"}
+
+func nameUUID(prefix string, index int) []byte {
+	return []byte(uuid.NewSHA1(uuid.NameSpace_URL, []byte(fmt.Sprintf("%v%v", prefix, index + 1))))
+}
+
+/* Reads a UUID file: one UUID per line, blank lines and lines starting with
+   # are ignored. */
+func readUUIDFile(path string) ([][]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var uuids [][]byte
+	for n, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var parsed uuid.UUID = uuid.Parse(line)
+		if parsed == nil {
+			return nil, fmt.Errorf("%v:%v: invalid UUID %v", path, n + 1, line)
+		}
+		uuids = append(uuids, []byte(parsed))
+	}
+	return uuids, nil
+}
+
+func writeUUIDFile(path string, uuids [][]byte) error {
+	var lines []string = []string{"# Stream UUIDs generated by quasarloadgenerator (UUID_MODE=random)"}
+	for _, u := range uuids {
+		lines = append(lines, uuid.UUID(u).String())
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n") + "\n"), 0644)
+}
+
+/* Returns the UUIDs of the numStreams streams as selected by UUID_MODE. If
+   create is false, a missing UUID_FILE in random mode is not an error and
+   nil is returned instead of writing the file. */
+func getStreamUUIDs(config map[string]interface{}, numStreams int, create bool) ([][]byte, error) {
+	var mode string = config["UUID_MODE"].(string)
+	var path string = config["UUID_FILE"].(string)
+	var uuids [][]byte
+	switch mode {
+	case "list":
+		uuids = make([][]byte, numStreams)
+		for j := 0; j < numStreams; j++ {
+			uuids[j] = []byte(uuid.Parse(config[fmt.Sprintf("UUID%v", j + 1)].(string)))
+		}
+		return uuids, nil
+	case "name":
+		var prefix string = config["UUID_PREFIX"].(string)
+		uuids = make([][]byte, numStreams)
+		for j := 0; j < numStreams; j++ {
+			uuids[j] = nameUUID(prefix, j)
+		}
+		return uuids, nil
+	case "random":
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if !create {
+				return nil, nil
+			}
+			uuids = make([][]byte, numStreams)
+			for j := 0; j < numStreams; j++ {
+				uuids[j] = []byte(uuid.NewRandom())
+			}
+			if err = writeUUIDFile(path, uuids); err != nil {
+				return nil, err
+			}
+			fmt.Printf("Wrote %v new UUIDs to %v\n", numStreams, path)
+			return uuids, nil
+		}
+		fallthrough
+	case "file":
+		uuids, err := readUUIDFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(uuids) < numStreams {
+			return nil, fmt.Errorf("%v contains %v UUIDs, but NUM_STREAMS is %v", path, len(uuids), numStreams)
+		}
+		return uuids[:numStreams], nil
+	}
+	return nil, fmt.Errorf("unknown UUID_MODE %v", mode)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/lilvinz/quasarloadgenerator/loadgen"
+)
+
+/* A configProblem describes something wrong with the configuration and,
+   when we know one, how to fix it. */
+type configProblem struct {
+	key string
+	message string
+	fix string
+}
+
+func (p configProblem) String() string {
+	var str string = p.message
+	if p.key != "" {
+		str = p.key + ": " + str
+	}
+	if p.fix != "" {
+		str += "\n      fix: " + p.fix
+	}
+	return str
+}
+
+var boolSettings map[string]bool = map[string]bool{
+	"DETERMINISTIC_KV": true,
+	"GET_MESSAGE_TIMES": true,
+	"DATA_TIME_SHIFT": true,
+	"DATA_LOOP": true,
+}
+
+var durationSettings map[string]bool = map[string]bool{
+	"DURATION": true,
+}
+
+/* Settings that are strings; those with choices must be one of them. The
+   choices of the runner's settings are checked by the runner. */
+var stringSettings map[string][]string = map[string][]string{
+	"UUID_MODE": uuidModes,
+	"UUID_PREFIX": nil,
+	"UUID_FILE": nil,
+	"ROUTING": nil,
+	"CONN_ASSIGNMENT": nil,
+	"SEND_MODE": nil,
+	"TIME_PATTERN": nil,
+	"QUERY_ACCESS": nil,
+	"QUERY_RANGES": nil,
+	"DUPLICATES": nil,
+}
+
+func countList(config map[string]interface{}, key string) int {
+	var n int = 0
+	for {
+		if _, ok := config[fmt.Sprintf("%v%v", key, n + 1)]; !ok {
+			return n
+		}
+		n++
+	}
+}
+
+/* Checks the configuration for the given command ("insert", "query",
+   "verify", "delete", "flush", "mixed", or "" to skip the checks that depend on the
+   command) and returns every problem that it finds, rather than stopping
+   at the first one. */
+func validateConfig(config map[string]interface{}, command string) []configProblem {
+	var problems []configProblem
+	var report = func (key string, fix string, format string, args ...interface{}) {
+		problems = append(problems, configProblem{key, fmt.Sprintf(format, args...), fix})
+	}
+
+	/* Parse everything first. Checks that depend on a key that could not be
+	   parsed are skipped, so that a single typo is only reported once. */
+	var ints map[string]int64 = make(map[string]int64)
+	var bools map[string]bool = make(map[string]bool)
+	for _, s := range settings {
+		elem, ok := config[s.key]
+		if !ok {
+			report(s.key, fmt.Sprintf("add %v=<value> to the configuration file or pass -%v", s.key, flagName(s.key)), "missing")
+			continue
+		}
+		str, ok := elem.(string)
+		if !ok {
+			report(s.key, "", "expected a single value, got %v", elem)
+			continue
+		}
+		if boolSettings[s.key] {
+			if str != "true" && str != "false" {
+				report(s.key, fmt.Sprintf("set %v to true or false", s.key), "could not parse %q as a boolean", str)
+				continue
+			}
+			bools[s.key] = (str == "true")
+			continue
+		}
+		if choices, ok := stringSettings[s.key]; ok {
+			var valid bool = (choices == nil)
+			for _, choice := range choices {
+				valid = valid || (str == choice)
+			}
+			if !valid {
+				report(s.key, fmt.Sprintf("set %v to one of %v", s.key, strings.Join(choices, ", ")), "unknown value %q", str)
+			}
+			continue
+		}
+		if durationSettings[s.key] {
+			if _, err := time.ParseDuration(str); err != nil {
+				report(s.key, fmt.Sprintf("set %v to a duration like 90s or 10m, or to 0", s.key), "could not parse %q as a duration", str)
+			}
+			continue
+		}
+		intval, err := strconv.ParseInt(str, 0, 64)
+		if err != nil {
+			report(s.key, fmt.Sprintf("set %v to an integer, e.g. %v", s.key, s.def), "could not parse %q as an int64", str)
+			continue
+		}
+		ints[s.key] = intval
+	}
+	var have = func (keys ...string) bool {
+		for _, key := range keys {
+			if _, ok := ints[key]; !ok {
+				if _, ok = bools[key]; !ok {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	for _, key := range []string{"NUM_SERVERS", "NUM_STREAMS"} {
+		if have(key) && ints[key] <= 0 {
+			report(key, fmt.Sprintf("set %v to a positive number", key), "must be positive, got %v", ints[key])
+			delete(ints, key)
+		}
+	}
+	if have("POINTS_PER_MESSAGE") && ints["POINTS_PER_MESSAGE"] > 0xFFFFFFFF {
+		report("POINTS_PER_MESSAGE", "use fewer points per message", "must fit in 32 bits, got %v", ints["POINTS_PER_MESSAGE"])
+		delete(ints, "POINTS_PER_MESSAGE")
+	}
+	if have("TOTAL_RECORDS", "POINTS_PER_MESSAGE") && ints["POINTS_PER_MESSAGE"] > 0 && ints["TOTAL_RECORDS"] % ints["POINTS_PER_MESSAGE"] != 0 {
+		var rounded int64 = (ints["TOTAL_RECORDS"] / ints["POINTS_PER_MESSAGE"] + 1) * ints["POINTS_PER_MESSAGE"]
+		report("TOTAL_RECORDS", fmt.Sprintf("set TOTAL_RECORDS to %v", rounded), "must be a multiple of POINTS_PER_MESSAGE (%v), got %v", ints["POINTS_PER_MESSAGE"], ints["TOTAL_RECORDS"])
+	}
+
+	if have("NUM_SERVERS") {
+		var n int = countList(config, "DB_ADDR")
+		if int64(n) != ints["NUM_SERVERS"] {
+			report("DB_ADDR", fmt.Sprintf("set NUM_SERVERS=%v or list DB_ADDR1 ... DB_ADDR%v", n, ints["NUM_SERVERS"]), "%v addresses are specified, but NUM_SERVERS is %v", n, ints["NUM_SERVERS"])
+		}
+	}
+	if routing, _ := config["ROUTING"].(string); routing == "map" {
+		var dbAddrs []string
+		for i := 1; i <= countList(config, "DB_ADDR"); i++ {
+			addr, _ := config[fmt.Sprintf("DB_ADDR%v", i)].(string)
+			dbAddrs = append(dbAddrs, addr)
+		}
+		if _, err := readRoutes(config, dbAddrs); err != nil {
+			report("ROUTE", "list each stream as ROUTE<n>=<UUID>,<DB_ADDR> with one of the DB_ADDRs", "%v", err)
+		}
+	} else if countList(config, "ROUTE") != 0 {
+		report("ROUTING", "set ROUTING=map to use ROUTE1, ROUTE2, ...", "ROUTE1 is set, but ROUTING is %v", routing)
+	}
+
+	var uuidMode, _ = config["UUID_MODE"].(string)
+	if uuidMode == "list" {
+		if have("NUM_STREAMS") {
+			var n int = countList(config, "UUID")
+			if int64(n) != ints["NUM_STREAMS"] {
+				report("UUID", fmt.Sprintf("set NUM_STREAMS=%v or list UUID1 ... UUID%v, or use UUID_MODE=name for many streams", n, ints["NUM_STREAMS"]), "%v UUIDs are specified, but NUM_STREAMS is %v", n, ints["NUM_STREAMS"])
+			}
+		}
+		for i := 1; i <= countList(config, "UUID"); i++ {
+			var key string = fmt.Sprintf("UUID%v", i)
+			str, ok := config[key].(string)
+			if !ok || uuid.Parse(str) == nil {
+				report(key, "use the form 9f67541c-95ee-11e4-a7ac-0026b6df9cf2", "invalid UUID %v", config[key])
+			}
+		}
+	} else if (uuidMode == "file" || uuidMode == "random") && have("NUM_STREAMS") {
+		if _, err := getStreamUUIDs(config, int(ints["NUM_STREAMS"]), false); err != nil {
+			var fix string = "point UUID_FILE to a file with one UUID per line"
+			if uuidMode == "random" {
+				fix = "delete UUID_FILE to generate new UUIDs, or lower NUM_STREAMS"
+			}
+			report("UUID_FILE", fix, "%v", err)
+		}
+	}
+
+	for i := 1; i <= countList(config, "DATA_FILE"); i++ {
+		path, _ := config[fmt.Sprintf("DATA_FILE%v", i)].(string)
+		if _, err := os.Stat(path); err != nil {
+			report(fmt.Sprintf("DATA_FILE%v", i), "point DATA_FILE to a CSV or .bin file with the points of a stream", "%v", err)
+		}
+	}
+	if value, ok := config["TIME_PATTERN"].(string); ok {
+		if _, err := loadgen.ParseTimePattern(value); err != nil {
+			report("TIME_PATTERN", "see the usage of -time-pattern, or set it to none", "%v", err)
+		}
+	}
+	if value, ok := config["QUERY_ACCESS"].(string); ok {
+		if _, err := loadgen.ParseQueryAccess(value); err != nil {
+			report("QUERY_ACCESS", "see the usage of -query-access, or set it to none", "%v", err)
+		}
+	}
+	if value, ok := config["QUERY_RANGES"].(string); ok {
+		if _, err := loadgen.ParseQueryRanges(value); err != nil {
+			report("QUERY_RANGES", "see the usage of -query-ranges, or set it to none", "%v", err)
+		}
+	}
+
+	/* Everything else is checked by the runner, so that programs that use it
+	   get the same checks. Settings with a problem are replaced by their
+	   defaults to check the rest, and a problem that is already reported is
+	   not reported again. */
+	var runnable map[string]interface{} = make(map[string]interface{})
+	for key, value := range config {
+		runnable[key] = value
+	}
+	for _, s := range settings {
+		if reported(problems, s.key) {
+			runnable[s.key] = s.def
+		}
+	}
+	cfg, err := buildRunConfig("", command, runnable, false, CHECK_UUID_FILE)
+	if err != nil && !reportedPrefix(problems, "NUM_SERVERS", "DB_ADDR", "ROUTE", "NUM_STREAMS", "UUID") {
+		report("", "", "%v", err) // the lists are checked above, with more advice
+	}
+	if cfg.UUIDS == nil { // UUID_MODE=random without a UUID_FILE yet, or UUIDs with a problem
+		numStreams, _ := getIntFromConfig("NUM_STREAMS", runnable)
+		for i := int64(0); i < numStreams; i++ {
+			cfg.UUIDS = append(cfg.UUIDS, make([]byte, 16))
+		}
+	}
+	if command == "" {
+		cfg.Command = "insert" // has none of the checks that depend on the command
+	}
+	for _, p := range cfg.Check() {
+		if p.Key == "" || !reported(problems, p.Key) {
+			report(p.Key, p.Fix, "%v", p.Message)
+		}
+	}
+
+	return problems
+}
+
+/* Returns whether there is a problem with any of the keys. */
+func reported(problems []configProblem, keys ...string) bool {
+	for _, p := range problems {
+		for _, key := range keys {
+			if p.key == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Returns whether there is a problem with a key that starts with any of the
+   prefixes, such as UUID for UUID3. */
+func reportedPrefix(problems []configProblem, prefixes ...string) bool {
+	for _, p := range problems {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(p.key, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func printProblems(source string, problems []configProblem) {
+	if len(problems) == 1 {
+		fmt.Printf("There is a problem with the configuration in %v:\n", source)
+	} else {
+		fmt.Printf("There are %v problems with the configuration in %v:\n", len(problems), source)
+	}
+	for _, p := range problems {
+		fmt.Printf("  %v\n", p)
+	}
+}
+
+/* The "validate" command checks the configuration without connecting to anything. */
+func validateCommand(args []string) {
+	var command string = ""
+	if len(args) > 0 {
+		switch args[0] {
+		case "insert", "query", "verify", "delete", "flush", "mixed":
+			command = args[0]
+			args = args[1:]
+		}
+	}
+	var opts runOptions
+	newRunFlags("validate", &opts).Parse(args)
+	config, isErr := loadConfig(&opts)
+	if isErr {
+		os.Exit(1)
+	}
+	groups, isErr := loadGroups(&opts, config)
+	if isErr {
+		os.Exit(1)
+	}
+	if len(groups) != 0 {
+		if !validateGroups(groups, command) {
+			os.Exit(1)
+		}
+		fmt.Printf("%v and its %v groups are valid\n", opts.configPath, len(groups))
+		return
+	}
+	var problems []configProblem = validateConfig(config, command)
+	if len(problems) != 0 {
+		printProblems(opts.configPath, problems)
+		os.Exit(1)
+	}
+	fmt.Printf("%v is valid\n", opts.configPath)
+}